@@ -16,6 +16,7 @@ import (
 
 	"github.com/semanticize/st/internal/dumpparser"
 	"github.com/semanticize/st/internal/storage"
+	"github.com/semanticize/st/wikidump"
 )
 
 func init() {
@@ -35,14 +36,95 @@ var (
 		"number of columns in count-min sketch").Default("16777216").Int()
 	maxNGram = kingpin.Flag("ngram",
 		"max. length of n-grams").Default(strconv.Itoa(storage.DefaultMaxNGram)).Int()
+	titleCount = kingpin.Flag("titlecount",
+		"use article titles as anchors with this pseudo-count").Default("0").Float()
+	redirectCount = kingpin.Flag("redirectcount",
+		"use redirect titles as anchors with this pseudo-count").Default("0").Float()
+	aliasCount = kingpin.Flag("aliascount",
+		"use bold names in article leads as anchors with this pseudo-count").Default("0").Float()
+	dropRedLinks = kingpin.Flag("dropredlinks",
+		"remove link targets that are not articles in the dump").Bool()
+	disambig = kingpin.Flag("disambig",
+		"name of template that marks disambiguation pages (repeatable)").Strings()
+	linksIn = kingpin.Flag("linksin",
+		"also take links from templates, navboxes, tables or tags (repeatable)").Strings()
+	pageProps = kingpin.Flag("pageprops",
+		"path to page_props SQL dump, for Wikidata ids").String()
+	langLinks = kingpin.Flag("langlinks",
+		"path to langlinks SQL dump, for cross-lingual linking").String()
+	langs = kingpin.Flag("lang",
+		"only import interlanguage links to this language (repeatable)").Strings()
+	categories = kingpin.Flag("categories",
+		"record categories from category links in wikitext").Bool()
+	categoryLinks = kingpin.Flag("categorylinks",
+		"path to categorylinks SQL dump, for categories").String()
+	infoboxTypes = kingpin.Flag("infoboxtypes",
+		"file mapping infobox names to entity types (name<TAB>type per line)").String()
+	pageviews = kingpin.Flag("pageviews",
+		"path to pageview or clickstream dump, for popularity (repeatable)").Strings()
+	pageviewsProject = kingpin.Flag("pageviewsproject",
+		"project code in pageview dumps (default: from dump's dbname)").String()
+	clickstream = kingpin.Flag("clickstream",
+		"path to clickstream dump, for click counts per anchor (repeatable)").Strings()
+	abstracts = kingpin.Flag("abstracts",
+		"store article abstracts of at most this many bytes (0 for none)").Default("0").Int()
+	plainText = kingpin.Flag("plaintext",
+		"count n-grams in fully rendered text instead of cleaned-up wikitext").Bool()
 )
 
+var markupNames = map[string]wikidump.Markup{
+	"templates": wikidump.TemplateMarkup,
+	"navboxes":  wikidump.NavboxMarkup,
+	"tables":    wikidump.TableMarkup,
+	"tags":      wikidump.TagMarkup,
+	"all":       wikidump.AllMarkup,
+}
+
 func main() {
 	kingpin.Parse()
 
 	l := log.New(os.Stderr, "dumpparser ", log.Ldate|log.Ltime)
-	err := dumpparser.Main(*dbpath, *dumppath, *download, *nrows, *ncols,
-		*maxNGram, l)
+	opts := dumpparser.Options{
+		NRows:         *nrows,
+		NCols:         *ncols,
+		MaxNGram:      *maxNGram,
+		TitleCount:    *titleCount,
+		RedirectCount: *redirectCount,
+		AliasCount:    *aliasCount,
+		DropRedLinks:  *dropRedLinks,
+		PlainText:     *plainText,
+		PageProps:     *pageProps,
+		LangLinks:     *langLinks,
+		Langs:         *langs,
+		Categories:    *categories,
+		CategoryLinks: *categoryLinks,
+
+		AbstractLength:   *abstracts,
+		Pageviews:        *pageviews,
+		PageviewsProject: *pageviewsProject,
+		Clickstream:      *clickstream,
+	}
+	if len(*disambig) > 0 {
+		opts.DisambigTemplates = *disambig
+	}
+	if *infoboxTypes != "" {
+		f, err := os.Open(*infoboxTypes)
+		if err == nil {
+			opts.InfoboxTypes, err = wikidump.ReadInfoboxTypes(f)
+			f.Close()
+		}
+		if err != nil {
+			l.Fatal(err)
+		}
+	}
+	for _, name := range *linksIn {
+		m, ok := markupNames[name]
+		if !ok {
+			l.Fatalf("unknown markup %q for --linksin", name)
+		}
+		opts.LinkMarkup |= m
+	}
+	err := dumpparser.Main(*dbpath, *dumppath, *download, &opts, l)
 	if err != nil {
 		l.Fatal(err)
 	}
@@ -0,0 +1,120 @@
+// Semanticizer, STandalone: plain text extractor for Wikipedia database dumps.
+//
+// Renders the articles in a Wikipedia database dump as plain text and writes
+// them to standard output as JSON, one article per line, with the positions
+// of the links in each article's text.
+//
+// Run with --help for command-line usage.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"runtime"
+	"sync"
+
+	"gopkg.in/alecthomas/kingpin.v1"
+
+	"github.com/semanticize/st/wikidump"
+)
+
+func init() {
+	if os.Getenv("GOMAXPROCS") == "" {
+		runtime.GOMAXPROCS(runtime.NumCPU())
+	}
+}
+
+var (
+	dumppath = kingpin.Arg("dump", "path to Wikipedia dump").Required().String()
+	maxPages = kingpin.Flag("max",
+		"stop after this many articles (0 for no limit)").Default("0").Int()
+)
+
+// An article, as written to the output.
+type article struct {
+	Title string              `json:"title"`
+	ID    int64               `json:"id"`
+	Text  string              `json:"text"`
+	Links []wikidump.LinkSpan `json:"links"`
+}
+
+func readSiteInfo(path string) (*wikidump.SiteInfo, error) {
+	f, err := wikidump.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return wikidump.ReadSiteInfo(f)
+}
+
+func main() {
+	kingpin.Parse()
+	l := log.New(os.Stderr, "extract ", log.Ldate|log.Ltime)
+
+	siteinfo, err := readSiteInfo(*dumppath)
+	if err != nil {
+		l.Printf("%v; using defaults", err)
+		siteinfo = wikidump.DefaultSiteInfo
+	}
+
+	// Not closed: with --max, GetPages may still be reading when we're done.
+	f, err := wikidump.Open(*dumppath)
+	if err != nil {
+		l.Fatal(err)
+	}
+
+	pages, redirects := make(chan *wikidump.Page), make(chan *wikidump.Redirect)
+	go wikidump.GetPages(f, pages, redirects)
+	go func() {
+		for _ = range redirects {
+		}
+	}()
+
+	// Render in parallel, but write in dump order.
+	type result struct {
+		done chan struct{}
+		a    article
+	}
+	results := make(chan *result, 4*runtime.GOMAXPROCS(0))
+	go func() {
+		var wg sync.WaitGroup
+		npages := 0
+		for p := range pages {
+			if *maxPages > 0 && npages == *maxPages {
+				// GetPages blocks on its next send, so the rest of the
+				// dump is never read. It's abandoned when main returns.
+				break
+			}
+			npages++
+
+			res := &result{done: make(chan struct{})}
+			results <- res
+			wg.Add(1)
+			go func(p *wikidump.Page) {
+				defer wg.Done()
+				text, links := siteinfo.PlainText(p.Text)
+				if links == nil {
+					links = []wikidump.LinkSpan{}
+				}
+				res.a = article{p.Title, p.ID, text, links}
+				close(res.done)
+			}(p)
+		}
+		wg.Wait()
+		close(results)
+	}()
+
+	out := bufio.NewWriter(os.Stdout)
+	enc := json.NewEncoder(out)
+	for res := range results {
+		<-res.done
+		if err = enc.Encode(&res.a); err != nil {
+			l.Fatal(err)
+		}
+	}
+	if err = out.Flush(); err != nil {
+		l.Fatal(err)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+
+	"github.com/semanticize/st/linking"
+)
+
+// Default for serverConfig.MaxBodySize.
+const defaultMaxBodySize = 32 << 20
+
+// An error to report to the client, with an HTTP status code. Sent as
+// {"error": message, "status": code}.
+type httpError struct {
+	Message string `json:"error"`
+	Status  int    `json:"status"`
+}
+
+func (e *httpError) Error() string { return e.Message }
+
+func newError(status int, format string, args ...interface{}) *httpError {
+	return &httpError{fmt.Sprintf(format, args...), status}
+}
+
+func badRequest(err error) error {
+	if _, ok := err.(*httpError); ok {
+		return err
+	}
+	return &httpError{err.Error(), http.StatusBadRequest}
+}
+
+// Classify an error from the Semanticizer. A closed model means there's
+// nothing to serve from; anything else is our fault.
+func linkingError(err error) error {
+	if err == linking.ErrClosed {
+		return newError(http.StatusServiceUnavailable, "model unavailable")
+	}
+	return &httpError{err.Error(), http.StatusInternalServerError}
+}
+
+// Write err to w as a JSON error. Errors that aren't *httpError are reported
+// as internal server errors. Nothing should be written to w afterwards.
+func writeError(w http.ResponseWriter, err error) {
+	e, ok := err.(*httpError)
+	if !ok {
+		e = &httpError{err.Error(), http.StatusInternalServerError}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(e)
+}
+
+// Write v to w as JSON, with status 200.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(v)
+}
+
+// Reports whether req's body has the given media type. An absent
+// Content-Type matches if allowMissing is set.
+func hasMediaType(req *http.Request, allowMissing bool,
+	types ...string) bool {
+
+	ct := req.Header.Get("Content-Type")
+	if ct == "" {
+		return allowMissing
+	}
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+	for _, t := range types {
+		if mt == t {
+			return true
+		}
+	}
+	return false
+}
+
+func isJSON(req *http.Request) bool {
+	return hasMediaType(req, false, "application/json")
+}
+
+func unsupportedMediaType(expected string) error {
+	return newError(http.StatusUnsupportedMediaType,
+		"expected Content-Type %s", expected)
+}
+
+// Limit the size of req's body to max bytes. Reading beyond that gives an
+// error that readError turns into 413 Request Entity Too Large.
+func limitBody(w http.ResponseWriter, req *http.Request,
+	max int64) io.Reader {
+
+	return http.MaxBytesReader(w, req.Body, max)
+}
+
+// Reports whether err comes from reading beyond the limit set by limitBody.
+func tooLarge(err error) bool {
+	return err.Error() == "http: request body too large"
+}
+
+// Classify an error that occurred while reading a request body limited to
+// max bytes.
+func readError(err error, max int64) error {
+	if tooLarge(err) {
+		return newError(http.StatusRequestEntityTooLarge,
+			"request body larger than %d bytes", max)
+	}
+	return badRequest(err)
+}
+
+// Read req's entire body, up to max bytes.
+func readBody(w http.ResponseWriter, req *http.Request,
+	max int64) ([]byte, error) {
+
+	body, err := ioutil.ReadAll(limitBody(w, req, max))
+	if err != nil {
+		return nil, readError(err, max)
+	}
+	return body, nil
+}
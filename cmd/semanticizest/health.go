@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/semanticize/st/internal/storage"
+	"github.com/semanticize/st/linking"
+)
+
+// Reports that the server is up, regardless of the state of the model.
+func healthz(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, map[string]string{"status": "ok"})
+}
+
+// Reports whether the model can be queried: 200 if so, 503 otherwise.
+type readyHandler struct{ *linking.Semanticizer }
+
+func (h readyHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if err := h.Ping(); err != nil {
+		writeError(w, newError(http.StatusServiceUnavailable,
+			"model unavailable: %v", err))
+		return
+	}
+	writeJSON(w, map[string]string{"status": "ready"})
+}
+
+// Describes the model as JSON: the settings it was built with, the number of
+// rows in each table and the dimensions of the n-gram count sketch. Also
+// lists the names of all models being served.
+type modelInfoHandler struct {
+	*linking.Semanticizer
+	settings *storage.Settings
+	models   []string
+}
+
+type modelInfo struct {
+	Models   []string          `json:"models"`
+	Settings *storage.Settings `json:"settings"`
+	Tables   map[string]int64  `json:"tables"`
+	Sketch   struct {
+		Rows int `json:"rows"`
+		Cols int `json:"cols"`
+	} `json:"sketch"`
+}
+
+func (h modelInfoHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var info modelInfo
+	info.Models, info.Settings = h.models, h.settings
+	info.Tables = h.TableSizes()
+	info.Sketch.Rows, info.Sketch.Cols = h.SketchSize()
+	writeJSON(w, &info)
+}
@@ -12,7 +12,10 @@ import (
 	"encoding/json"
 	"log"
 	"os"
+	"os/signal"
 	"regexp"
+	"strconv"
+	"syscall"
 
 	"gopkg.in/alecthomas/kingpin.v1"
 
@@ -37,11 +40,44 @@ func splitPara(data []byte, atEOF bool) (advance int, token []byte, err error) {
 }
 
 var (
-	dbpath = kingpin.Arg("model", "path to model file").Required().String()
+	dbpath    = kingpin.Arg("model", "path to model file").String()
+	modelArgs = kingpin.Flag("model",
+		"serve the model at path as name, given as name=path (repeatable)").Strings()
 	dohttp = kingpin.Flag("http",
 		"HTTP server address; use :0 for a random port").Default("").String()
 	portfile = kingpin.Flag("portfile",
 		"write server port to this file (useful with :0)").Default("").String()
+	titles = kingpin.Flag("titles",
+		"count titles and redirects used as anchors as links").Bool()
+	aliases = kingpin.Flag("aliases",
+		"count alternative names from article leads as links").Bool()
+	noDisambig = kingpin.Flag("nodisambig",
+		"leave out disambiguation pages").Bool()
+	expandDisambig = kingpin.Flag("expanddisambig",
+		"add options listed on disambiguation pages as candidates").Bool()
+	lang = kingpin.Flag("lang",
+		"map targets to this language's Wikipedia (e.g., en)").String()
+	categories = kingpin.Flag("category",
+		"only return targets in this category or its subcategories (repeatable)").Strings()
+	categoryDepth = kingpin.Flag("categorydepth",
+		"max. depth of subcategories for --category").Default("0").Int()
+	showCategories = kingpin.Flag("showcategories",
+		"list the categories of each target").Bool()
+	dropUntranslated = kingpin.Flag("dropuntranslated",
+		"with --lang, leave out targets that have no equivalent").Bool()
+	descriptions = kingpin.Flag("descriptions",
+		"give each target's abstract as its description").Bool()
+
+	readTimeout = kingpin.Flag("readtimeout",
+		"max. time to read an HTTP request; 0 means no limit").Default("1m").Duration()
+	writeTimeout = kingpin.Flag("writetimeout",
+		"max. time to write an HTTP response; 0 means no limit").Default("5m").Duration()
+	shutdownTimeout = kingpin.Flag("shutdowntimeout",
+		"on SIGINT or SIGTERM, max. time to wait for requests in progress").Default("30s").Duration()
+	maxBody = kingpin.Flag("maxbody",
+		"max. size of HTTP request bodies, in bytes (not for full-duplex /stream)").Default(strconv.Itoa(defaultMaxBodySize)).Int64()
+	adminToken = kingpin.Flag("admintoken",
+		"enable POST /admin/reload with this bearer token (default $SEMANTICIZEST_ADMIN_TOKEN)").String()
 )
 
 func main() {
@@ -56,12 +92,45 @@ func main() {
 		}
 	}
 
-	log.Printf("loading database from %s", *dbpath)
-	sem, settings, err := linking.Load(*dbpath)
+	paths, err := parseModelArgs(*modelArgs)
 	check()
-	log.Print("database loaded")
+	def := ""
+	if *dbpath != "" {
+		if _, dup := paths[defaultModel]; dup {
+			log.Fatalf("model %q given twice", defaultModel)
+		}
+		paths[defaultModel] = *dbpath
+		def = defaultModel
+	}
+
+	opts := linking.Options{
+		TitleAnchors:          *titles,
+		Aliases:               *aliases,
+		ExcludeDisambiguation: *noDisambig,
+		ExpandDisambiguation:  *expandDisambig,
+		Lang:                  *lang,
+		DropUntranslated:      *dropUntranslated,
+		Categories:            *categories,
+		CategoryDepth:         *categoryDepth,
+		ShowCategories:        *showCategories,
+		Descriptions:          *descriptions,
+	}
 
 	if *dohttp == "" {
+		if len(paths) != 1 {
+			log.Fatal("need exactly one model when not serving over HTTP")
+		}
+		var path string
+		for _, p := range paths {
+			path = p
+		}
+		log.Printf("loading database from %s", path)
+		var sem *linking.Semanticizer
+		sem, _, err = linking.Load(path)
+		check()
+		log.Print("database loaded")
+		*sem = sem.WithOptions(opts)
+
 		scanner := bufio.NewScanner(os.Stdin)
 		scanner.Split(splitPara)
 
@@ -78,6 +147,37 @@ func main() {
 		err = scanner.Err()
 		check()
 	} else {
-		log.Fatal(restServer(*dohttp, *portfile, sem, settings))
+		if *adminToken == "" {
+			*adminToken = os.Getenv("SEMANTICIZEST_ADMIN_TOKEN")
+		}
+		cfg := &serverConfig{
+			ReadTimeout:     *readTimeout,
+			WriteTimeout:    *writeTimeout,
+			ShutdownTimeout: *shutdownTimeout,
+			AdminToken:      *adminToken,
+			MaxBodySize:     *maxBody,
+		}
+		var models *modelSet
+		models, err = loadModels(paths, def, opts, cfg.MaxBodySize)
+		check()
+
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for _ = range hup {
+				if _, err := models.reload(); err != nil {
+					log.Printf("reload failed: %v", err)
+				}
+			}
+		}()
+
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+		err = restServer(*dohttp, *portfile, models, cfg, stop)
+		check()
+		err = models.close()
+		check()
+		log.Print("server stopped")
 	}
 }
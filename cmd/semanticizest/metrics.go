@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/semanticize/st/linking"
+)
+
+// Metrics in the Prometheus text exposition format, version 0.0.4:
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+//
+// We implement the little we need rather than depend on the Prometheus
+// client library.
+
+// Histogram buckets (upper bounds).
+var (
+	latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5,
+		10}
+	sizeBuckets      = []float64{100, 1000, 10000, 100000, 1e6, 1e7}
+	candidateBuckets = []float64{0, 1, 5, 10, 50, 100, 500, 1000}
+)
+
+// A set of counters or histograms with the same name, distinguished by the
+// values of their labels.
+type metricVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64 // Histogram if non-nil, else counter.
+
+	mu     sync.Mutex
+	series map[string]*series // Keyed by formatted label pairs.
+}
+
+type series struct {
+	count  float64   // Counter value, or number of observations.
+	sum    float64   // Sum of observations.
+	counts []float64 // Non-cumulative bucket counts.
+}
+
+func newCounter(name, help string, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, labels: labels,
+		series: make(map[string]*series)}
+}
+
+func newHistogram(name, help string, buckets []float64,
+	labels ...string) *metricVec {
+
+	m := newCounter(name, help, labels...)
+	m.buckets = buckets
+	return m
+}
+
+// Add v to the counter, or record v in the histogram, with the given label
+// values.
+func (m *metricVec) observe(v float64, labelValues ...string) {
+	key := labelPairs(m.labels, labelValues)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.series[key]
+	if s == nil {
+		s = &series{counts: make([]float64, len(m.buckets))}
+		m.series[key] = s
+	}
+	if m.buckets == nil {
+		s.count += v
+		return
+	}
+	s.count++
+	s.sum += v
+	for i, b := range m.buckets {
+		if v <= b {
+			s.counts[i]++
+			break
+		}
+	}
+}
+
+func (m *metricVec) writeTo(w io.Writer) {
+	typ := "counter"
+	if m.buckets != nil {
+		typ = "histogram"
+	}
+	writeHeader(w, m.name, m.help, typ)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := m.series[k]
+		if m.buckets == nil {
+			writeSample(w, m.name, k, s.count)
+			continue
+		}
+		var cumul float64
+		for i, b := range m.buckets {
+			cumul += s.counts[i]
+			writeSample(w, m.name+"_bucket",
+				joinPairs(k, `le="`+formatFloat(b)+`"`), cumul)
+		}
+		writeSample(w, m.name+"_bucket", joinPairs(k, `le="+Inf"`), s.count)
+		writeSample(w, m.name+"_sum", k, s.sum)
+		writeSample(w, m.name+"_count", k, s.count)
+	}
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeSample(w io.Writer, name, labels string, v float64) {
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s%s %s\n", name, labels, formatFloat(v))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Format labels and their values as name="value" pairs.
+func labelPairs(labels, values []string) string {
+	pairs := make([]string, len(labels))
+	for i, l := range labels {
+		pairs[i] = l + `="` + labelEscaper.Replace(values[i]) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+func joinPairs(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// The metrics collected by the REST server.
+var metrics = struct {
+	requests, latency, docSize, candidates *metricVec
+}{
+	requests: newCounter("semanticizest_requests_total",
+		"HTTP requests served, by model, endpoint and status code.",
+		"model", "endpoint", "code"),
+	latency: newHistogram("semanticizest_request_duration_seconds",
+		"Time taken to serve HTTP requests, by model and endpoint.",
+		latencyBuckets, "model", "endpoint"),
+	docSize: newHistogram("semanticizest_document_bytes",
+		"Size of documents annotated.", sizeBuckets),
+	candidates: newHistogram("semanticizest_candidates",
+		"Number of candidate entities returned per document.",
+		candidateBuckets),
+}
+
+// Wrap method to record document sizes and numbers of candidates.
+func observeDocs(method func(linking.Semanticizer, string) ([]linking.Entity,
+	error)) func(linking.Semanticizer, string) ([]linking.Entity, error) {
+
+	return func(sem linking.Semanticizer, s string) ([]linking.Entity, error) {
+		cands, err := method(sem, s)
+		metrics.docSize.observe(float64(len(s)))
+		if err == nil {
+			metrics.candidates.observe(float64(len(cands)))
+		}
+		return cands, err
+	}
+}
+
+// Wrap h to count requests and record their latency under the labels model
+// (empty if the request is not for a particular model) and endpoint.
+func instrument(model, endpoint string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, req)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		metrics.requests.observe(1, model, endpoint, strconv.Itoa(sw.status))
+		metrics.latency.observe(time.Since(start).Seconds(), model, endpoint)
+	})
+}
+
+// Records the status code of a response. Passes on the optional methods that
+// the handlers use.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+var errNotSupported = errors.New("not supported by ResponseWriter")
+
+func (w *statusWriter) EnableFullDuplex() error {
+	if fd, ok := w.ResponseWriter.(interface {
+		EnableFullDuplex() error
+	}); ok {
+		return fd.EnableFullDuplex()
+	}
+	return errNotSupported
+}
+
+func (w *statusWriter) SetReadDeadline(t time.Time) error {
+	if rd, ok := w.ResponseWriter.(interface {
+		SetReadDeadline(time.Time) error
+	}); ok {
+		return rd.SetReadDeadline(t)
+	}
+	return errNotSupported
+}
+
+func (w *statusWriter) SetWriteDeadline(t time.Time) error {
+	if wd, ok := w.ResponseWriter.(interface {
+		SetWriteDeadline(time.Time) error
+	}); ok {
+		return wd.SetWriteDeadline(t)
+	}
+	return errNotSupported
+}
+
+// Serves the metrics, along with query statistics from the Semanticizers and
+// information about the models.
+type metricsHandler struct{ models *modelSet }
+
+func (h metricsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	served := make([]*servedModel, len(h.models.names))
+	for i, name := range h.models.names {
+		served[i] = h.models.models[name].acquire()
+		defer served[i].release()
+	}
+
+	writeHeader(bw, "semanticizest_model_info",
+		"Settings of the models being served.", "gauge")
+	for i, m := range served {
+		writeSample(bw, "semanticizest_model_info", labelPairs(
+			[]string{"model", "dumpname", "maxngram"},
+			[]string{h.models.names[i], m.settings.Dumpname,
+				strconv.Itoa(int(m.settings.MaxNGram))}), 1)
+	}
+
+	for _, m := range []*metricVec{metrics.requests, metrics.latency,
+		metrics.docSize, metrics.candidates} {
+		m.writeTo(bw)
+	}
+
+	// A summary without quantiles: just the count and total time.
+	const sqlName = "semanticizest_sql_query_duration_seconds"
+	writeHeader(bw, sqlName,
+		"Database queries made, by model and kind of query.", "summary")
+	for i, m := range served {
+		stats := m.sem.QueryStats()
+		kinds := make([]string, 0, len(stats))
+		for k := range stats {
+			kinds = append(kinds, k)
+		}
+		sort.Strings(kinds)
+		for _, k := range kinds {
+			label := labelPairs([]string{"model", "query"},
+				[]string{h.models.names[i], k})
+			writeSample(bw, sqlName+"_sum", label, stats[k].Time.Seconds())
+			writeSample(bw, sqlName+"_count", label, float64(stats[k].Count))
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram("test_seconds", "A test.", []float64{.5, 1}, "path")
+	for _, v := range []float64{.25, .75, 2} {
+		h.observe(v, `/a"b`)
+	}
+	var buf bytes.Buffer
+	h.writeTo(&buf)
+
+	expected := `# HELP test_seconds A test.
+# TYPE test_seconds histogram
+test_seconds_bucket{path="/a\"b",le="0.5"} 1
+test_seconds_bucket{path="/a\"b",le="1"} 2
+test_seconds_bucket{path="/a\"b",le="+Inf"} 3
+test_seconds_sum{path="/a\"b"} 3
+test_seconds_count{path="/a\"b"} 3
+`
+	if got := buf.String(); got != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, got)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	set, cleanup := testModels(t, "test")
+	defer cleanup()
+	mux := router{set, ""}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, newRequest("POST", "/all", "", "Mercury"))
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, newRequest("GET", "/nonexistent", "", ""))
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, newRequest("GET", "/metrics", "", ""))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct,
+		"text/plain; version=0.0.4") {
+		t.Errorf("wrong Content-Type %q", ct)
+	}
+	body := w.Body.String()
+	for _, expected := range []string{
+		"\nsemanticizest_model_info{model=\"test\",dumpname=\"testwiki\",maxngram=\"2\"} 1\n",
+		"\nsemanticizest_requests_total{model=\"test\",endpoint=\"/all\",code=\"200\"} ",
+		"\nsemanticizest_requests_total{model=\"test\",endpoint=\"/\",code=\"404\"} ",
+		"\nsemanticizest_request_duration_seconds_count{model=\"test\",endpoint=\"/all\"} ",
+		"\nsemanticizest_document_bytes_bucket{le=\"100\"} ",
+		"\nsemanticizest_candidates_sum ",
+		"\nsemanticizest_sql_query_duration_seconds_count{model=\"test\",query=\"candidates\"} ",
+		"\n# TYPE semanticizest_sql_query_duration_seconds summary\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("%q not found in\n%s", expected, body)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/semanticize/st/internal/storage"
+	"github.com/semanticize/st/linking"
+)
+
+// Name of the model given as a positional argument.
+const defaultModel = "default"
+
+var modelName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// First path segments of endpoints, which can't be used as model names.
+var reservedNames = map[string]bool{
+	"all": true, "exactmatch": true, "entity": true, "batch": true,
+	"stream": true, "readyz": true, "info": true, "healthz": true,
+	"metrics": true, "admin": true,
+}
+
+// The models served by one server, by name.
+type modelSet struct {
+	models map[string]*liveModel
+	names  []string   // Sorted.
+	def    *liveModel // For requests that name no model; may be nil.
+}
+
+// Load the models at the given paths, keyed by name, with the given options
+// and limit on request bodies. The model named def is used for requests that
+// name no model. If def is empty and there is only one model, that is the
+// default.
+func loadModels(paths map[string]string, def string, opts linking.Options,
+	maxBody int64) (set *modelSet, err error) {
+
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no model given")
+	}
+	set = &modelSet{models: make(map[string]*liveModel)}
+	for name := range paths {
+		if !modelName.MatchString(name) || reservedNames[name] {
+			return nil, fmt.Errorf("invalid model name %q", name)
+		}
+		set.names = append(set.names, name)
+	}
+	sort.Strings(set.names)
+
+	defer func() {
+		if err != nil {
+			set.close()
+			set = nil
+		}
+	}()
+	for _, name := range set.names {
+		lm := &liveModel{name: name, path: paths[name], opts: opts,
+			maxBody: maxBody, models: set.names}
+		if lm.current, err = lm.load(); err != nil {
+			return
+		}
+		set.models[name] = lm
+	}
+
+	if def == "" && len(set.names) == 1 {
+		def = set.names[0]
+	}
+	set.def = set.models[def]
+	return
+}
+
+// Reload all models. Returns the settings of the models reloaded; stops at
+// the first failure.
+func (set *modelSet) reload() (map[string]*storage.Settings, error) {
+	reloaded := make(map[string]*storage.Settings)
+	for _, name := range set.names {
+		settings, err := set.models[name].reload()
+		if err != nil {
+			return reloaded, fmt.Errorf("%s: %v", name, err)
+		}
+		reloaded[name] = settings
+	}
+	return reloaded, nil
+}
+
+// Wait for requests to finish, then close all models.
+func (set *modelSet) close() (err error) {
+	for _, lm := range set.models {
+		if e := lm.close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
+
+// Routes requests to models, by path prefix (/en/all) or query parameter
+// (/all?model=en), and instruments them.
+//
+// /healthz and /metrics are for the server as a whole. When a request names
+// no model and there is no default, /, /info and /readyz cover all models.
+type router struct {
+	models     *modelSet
+	adminToken string
+}
+
+func (rt router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	name, endpoint, h, release := rt.route(req)
+	defer release()
+	instrument(name, endpoint, h).ServeHTTP(w, req)
+}
+
+// Find the handler for req. Returns the name of the model it's for, the
+// endpoint to report it under in the metrics, and a function to call when
+// the request is done. Strips the model name from req's path.
+func (rt router) route(req *http.Request) (name, endpoint string,
+	h http.Handler, release func()) {
+
+	release = func() {}
+	path := req.URL.Path
+	switch path {
+	case "/healthz":
+		return "", path, http.HandlerFunc(healthz), release
+	case "/metrics":
+		return "", path, metricsHandler{rt.models}, release
+	}
+
+	var selected *liveModel // Named in the request.
+	prefix := strings.SplitN(path[1:], "/", 2)[0]
+	if m, ok := rt.models.models[prefix]; ok {
+		selected = m
+		stripPrefix(req, "/"+prefix)
+		path = req.URL.Path
+	} else if v := req.URL.Query().Get("model"); v != "" {
+		if selected = rt.models.models[v]; selected == nil {
+			return "", "", errorHandler(newError(http.StatusNotFound,
+				"no such model: %s", v)), release
+		}
+	}
+	lm := selected
+	if lm == nil {
+		lm = rt.models.def
+	}
+	if lm != nil {
+		name = lm.name
+	}
+
+	switch {
+	case path == "/admin/reload":
+		h = errorHandler(newError(http.StatusNotFound,
+			"no such endpoint: %s", path))
+		if rt.adminToken != "" {
+			h = reloadHandler{rt.models, selected, rt.adminToken}
+		}
+		return name, path, h, release
+	case lm != nil:
+		m := lm.acquire()
+		h, endpoint = m.handler.Handler(req)
+		return name, endpoint, h, m.release
+	case path == "/" || path == "/info" || path == "/readyz":
+		return "", path, allModelsHandler{rt.models}, release
+	}
+	return "", "/", errorHandler(newError(http.StatusBadRequest,
+		"no model given; use /<model>%s or ?model=<model>, with <model> one of %s",
+		path, strings.Join(rt.models.names, ", "))), release
+}
+
+// Remove prefix from req's path. / remains if nothing else does.
+func stripPrefix(req *http.Request, prefix string) {
+	u := *req.URL
+	u.Path = strings.TrimPrefix(u.Path, prefix)
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	req.URL = &u
+}
+
+func errorHandler(err error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		writeError(w, err)
+	})
+}
+
+// Serves /, /info and /readyz when no model is selected: the info page
+// listing the models, the settings of each model, and readiness of all
+// models.
+type allModelsHandler struct{ models *modelSet }
+
+func (h allModelsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	served := make(map[string]*servedModel, len(h.models.names))
+	for _, name := range h.models.names {
+		m := h.models.models[name].acquire()
+		defer m.release()
+		served[name] = m
+	}
+
+	switch req.URL.Path {
+	case "/":
+		info(w, req, nil, h.models.names)
+	case "/info":
+		settings := make(map[string]*storage.Settings, len(served))
+		for name, m := range served {
+			settings[name] = m.settings
+		}
+		writeJSON(w, map[string]interface{}{
+			"models": h.models.names, "settings": settings})
+	case "/readyz":
+		for _, name := range h.models.names {
+			if err := served[name].sem.Ping(); err != nil {
+				writeError(w, newError(http.StatusServiceUnavailable,
+					"model %s unavailable: %v", name, err))
+				return
+			}
+		}
+		writeJSON(w, map[string]string{"status": "ready"})
+	}
+}
+
+// Parses name=path arguments.
+func parseModelArgs(args []string) (map[string]string, error) {
+	paths := make(map[string]string, len(args))
+	for _, arg := range args {
+		i := strings.Index(arg, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("expected name=path, got %q", arg)
+		}
+		name, path := arg[:i], arg[i+1:]
+		if _, dup := paths[name]; dup {
+			return nil, fmt.Errorf("model %q given more than once", name)
+		}
+		paths[name] = path
+	}
+	return paths, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/semanticize/st/internal/storage"
+	"github.com/semanticize/st/linking"
+)
+
+// Serves a test model (see testModel) under each of names, with dumpname
+// name + "wiki". The returned function closes and removes them.
+func testModels(t *testing.T, names ...string) (*modelSet, func()) {
+	paths := make(map[string]string)
+	remove := func() {
+		for _, path := range paths {
+			os.Remove(path)
+		}
+	}
+	for _, name := range names {
+		sem, path := testModel(t)
+		sem.Close()
+		paths[name] = path
+		db, _, err := storage.LoadModel(path)
+		if err == nil {
+			_, err = db.Exec(`update parameters set value = ?
+			                  where key = "dumpname"`, name+"wiki")
+			db.Close()
+		}
+		if err != nil {
+			remove()
+			t.Fatal(err)
+		}
+	}
+	set, err := loadModels(paths, "", linking.Options{},
+		defaultMaxBodySize)
+	if err != nil {
+		remove()
+		t.Fatal(err)
+	}
+	return set, func() {
+		set.close()
+		remove()
+	}
+}
+
+func TestLoadModels(t *testing.T) {
+	for _, name := range []string{"all", "metrics", "a/b", ""} {
+		_, err := loadModels(map[string]string{name: "/nonexistent"}, "",
+			linking.Options{}, defaultMaxBodySize)
+		if err == nil || !strings.Contains(err.Error(), "invalid model name") {
+			t.Errorf("expected invalid model name error for %q, got %v",
+				name, err)
+		}
+	}
+
+	for _, args := range [][]string{{"en"}, {"=en.db"}, {"en=a", "en=b"}} {
+		if _, err := parseModelArgs(args); err == nil {
+			t.Errorf("expected error for %q", args)
+		}
+	}
+	paths, err := parseModelArgs([]string{"en=en.db", "nl=/a=b.db"})
+	if err != nil || paths["en"] != "en.db" || paths["nl"] != "/a=b.db" {
+		t.Errorf("wrong result %v, %v", paths, err)
+	}
+}
+
+func TestRouting(t *testing.T) {
+	set, cleanup := testModels(t, "en", "nl")
+	defer cleanup()
+	rt := router{set, ""}
+
+	if set.def != nil {
+		t.Errorf("got default model %q among several", set.def.name)
+	}
+
+	for _, c := range []struct {
+		method, url string
+		status      int
+		expected    string // Substring of response.
+	}{
+		{"GET", "/en/info", 200, `"dumpname":"enwiki"`},
+		{"GET", "/en/info", 200, `"models":["en","nl"]`},
+		{"GET", "/info?model=nl", 200, `"dumpname":"nlwiki"`},
+		{"GET", "/info", 200, `"models":["en","nl"]`},
+		{"GET", "/info", 200, `"nl":{"dumpname":"nlwiki"`},
+		{"POST", "/nl/all", 200, `"target":"Mercury (element)"`},
+		{"POST", "/all?model=en", 200, `"target":"Mercury (element)"`},
+		{"POST", "/all", 400, `no model given`},
+		{"POST", "/all?model=fr", 404, `no such model: fr`},
+		{"GET", "/readyz", 200, `"ready"`},
+		{"GET", "/nl/readyz", 200, `"ready"`},
+		{"GET", "/healthz", 200, `"ok"`},
+		{"GET", "/", 200, `href="/nl/"`},
+		{"GET", "/en", 200, `enwiki`},
+		{"GET", "/en/nonexistent", 404, `no such endpoint: /nonexistent`},
+		{"POST", "/admin/reload", 404, `no such endpoint`},
+	} {
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, newRequest(c.method, c.url, "", "Mercury"))
+		if w.Code != c.status {
+			t.Errorf("%s %s: expected status %d, got %d: %s",
+				c.method, c.url, c.status, w.Code, w.Body)
+		}
+		if body := w.Body.String(); !strings.Contains(body, c.expected) {
+			t.Errorf("%s %s: expected %s in response, got %s",
+				c.method, c.url, c.expected, body)
+		}
+	}
+}
+
+func TestDefaultModel(t *testing.T) {
+	set, cleanup := testModels(t, "test")
+	defer cleanup()
+	rt := router{set, ""}
+
+	w := httptest.NewRecorder()
+	rt.ServeHTTP(w, newRequest("GET", "/info", "", ""))
+	var info modelInfo
+	if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || info.Settings == nil ||
+		info.Settings.Dumpname != "testwiki" {
+		t.Errorf("wrong info for only model: %d %+v", w.Code, info)
+	}
+}
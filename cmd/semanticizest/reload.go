@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/semanticize/st/internal/storage"
+	"github.com/semanticize/st/linking"
+)
+
+// A model being served, with the handlers for it.
+type servedModel struct {
+	sem      *linking.Semanticizer
+	settings *storage.Settings
+	handler  *http.ServeMux
+
+	inflight sync.WaitGroup // Requests being served from this model.
+}
+
+// A model that can be replaced, by reloading it from its file, without
+// interrupting requests in progress.
+type liveModel struct {
+	name    string
+	path    string
+	opts    linking.Options
+	maxBody int64    // Largest request body, for newMux.
+	models  []string // Names of all models being served, for newMux.
+
+	reloading sync.Mutex // Serializes reloads.
+
+	mu      sync.RWMutex // Protects current.
+	current *servedModel
+}
+
+// Start serving from sem, loaded from lm.path with the given settings.
+func (lm *liveModel) serve(sem *linking.Semanticizer,
+	settings *storage.Settings) *servedModel {
+
+	return &servedModel{sem: sem, settings: settings,
+		handler: newMux(sem, settings, lm.models, lm.maxBody)}
+}
+
+// Load lm's model from its file.
+func (lm *liveModel) load() (*servedModel, error) {
+	log.Printf("loading database %s from %s", lm.name, lm.path)
+	sem, settings, err := linking.Load(lm.path)
+	if err != nil {
+		return nil, err
+	}
+	*sem = sem.WithOptions(lm.opts)
+	log.Printf("database %s loaded", lm.name)
+	return lm.serve(sem, settings), nil
+}
+
+// Returns the current model, which must be released after use.
+func (lm *liveModel) acquire() *servedModel {
+	lm.mu.RLock()
+	defer lm.mu.RUnlock()
+	m := lm.current
+	m.inflight.Add(1)
+	return m
+}
+
+func (m *servedModel) release() { m.inflight.Done() }
+
+// Load the model from its file again and start serving from the new copy.
+// The old copy is closed once the requests using it are done. If loading
+// fails, the old copy stays in use.
+func (lm *liveModel) reload() (*storage.Settings, error) {
+	lm.reloading.Lock()
+	defer lm.reloading.Unlock()
+
+	m, err := lm.load()
+	if err != nil {
+		return nil, err
+	}
+
+	lm.mu.Lock()
+	old := lm.current
+	lm.current = m
+	lm.mu.Unlock()
+
+	go func() {
+		old.inflight.Wait()
+		if err := old.sem.Close(); err != nil {
+			log.Printf("closing old database: %v", err)
+		}
+	}()
+	return m.settings, nil
+}
+
+// Wait for requests to finish, then close the current model.
+func (lm *liveModel) close() error {
+	lm.reloading.Lock()
+	defer lm.reloading.Unlock()
+	lm.mu.RLock()
+	m := lm.current
+	lm.mu.RUnlock()
+	m.inflight.Wait()
+	return m.sem.Close()
+}
+
+// Reloads a model, or all models if model is nil, on POST, given the bearer
+// token in the Authorization header. Responds with the settings of the
+// reloaded models.
+type reloadHandler struct {
+	models *modelSet
+	model  *liveModel
+	token  string
+}
+
+func (h reloadHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare(
+		[]byte(auth[len("Bearer "):]), []byte(h.token)) != 1 {
+
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, newError(http.StatusUnauthorized, "unauthorized"))
+		return
+	}
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeError(w, newError(http.StatusMethodNotAllowed,
+			"use POST to reload"))
+		return
+	}
+
+	reloaded := make(map[string]*storage.Settings)
+	var err error
+	if h.model != nil {
+		reloaded[h.model.name], err = h.model.reload()
+	} else {
+		reloaded, err = h.models.reload()
+	}
+	if err != nil {
+		writeError(w, newError(http.StatusInternalServerError,
+			"reload failed: %v", err))
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"status": "reloaded", "models": reloaded})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/semanticize/st/internal/storage"
+)
+
+// Count the entities found by /all in text.
+func countEntities(t *testing.T, h http.Handler, text string) int {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newRequest("POST", "/all", "", text))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	var ents []interface{}
+	if err := json.NewDecoder(w.Body).Decode(&ents); err != nil {
+		t.Fatal(err)
+	}
+	return len(ents)
+}
+
+func TestReload(t *testing.T) {
+	set, cleanup := testModels(t, "test")
+	defer cleanup()
+	rt := router{set, ""}
+	model, path := set.models["test"], set.models["test"].path
+
+	if n := countEntities(t, rt, "Mercury"); n != 2 {
+		t.Fatalf("expected 2 entities, got %d", n)
+	}
+
+	// Replace the model file by one in which Mercury has one candidate.
+	newSem, newPath := testModel(t)
+	newSem.Close()
+	db, _, err := storage.LoadModel(newPath)
+	if err == nil {
+		_, err = db.Exec(`delete from linkstats where targetid = 2`)
+		db.Close()
+	}
+	if err == nil {
+		err = os.Rename(newPath, path)
+	}
+	if err != nil {
+		os.Remove(newPath)
+		t.Fatal(err)
+	}
+
+	// A request in progress keeps the old model open.
+	old := model.acquire()
+	if _, err = model.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if n := countEntities(t, rt, "Mercury"); n != 1 {
+		t.Errorf("expected 1 entity after reload, got %d", n)
+	}
+	if n := countEntities(t, old.handler, "Mercury"); n != 2 {
+		t.Errorf("expected 2 entities from old model, got %d", n)
+	}
+
+	old.release()
+	for i := 0; old.sem.Ping() == nil; i++ {
+		if i == 100 {
+			t.Fatal("old model not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Failed reloads leave the model in place.
+	os.Remove(path)
+	if _, err = model.reload(); err == nil {
+		t.Error("expected error reloading removed model")
+	}
+	if n := countEntities(t, rt, "Mercury"); n != 1 {
+		t.Errorf("expected 1 entity after failed reload, got %d", n)
+	}
+}
+
+func TestReloadHandler(t *testing.T) {
+	set, cleanup := testModels(t, "test")
+	defer cleanup()
+	h := reloadHandler{set, nil, "secret"}
+
+	req := func(method, auth string) *http.Request {
+		r := newRequest(method, "/admin/reload", "", "")
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		return r
+	}
+	checkError(t, h, req("POST", ""), http.StatusUnauthorized)
+	checkError(t, h, req("POST", "Bearer wrong"), http.StatusUnauthorized)
+	checkError(t, h, req("GET", "Bearer secret"),
+		http.StatusMethodNotAllowed)
+
+	for _, h := range []reloadHandler{h, {set, set.models["test"], "secret"}} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req("POST", "Bearer secret"))
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+		expected := `"models":{"test":{"dumpname":"testwiki"`
+		if !strings.Contains(w.Body.String(), expected) {
+			t.Errorf("expected %s in response, got %s", expected, w.Body)
+		}
+	}
+}
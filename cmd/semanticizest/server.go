@@ -0,0 +1,111 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Settings for the HTTP server. Zero durations mean no timeout.
+type serverConfig struct {
+	ReadTimeout  time.Duration // Reading a request, including its body.
+	WriteTimeout time.Duration // From the end of the request headers.
+
+	// How long to wait for in-flight requests to finish on shutdown, before
+	// closing their connections.
+	ShutdownTimeout time.Duration
+
+	// Bearer token for /admin/reload. If empty, the endpoint is disabled.
+	AdminToken string
+
+	// Largest request body accepted by /all, /exactmatch and /batch, and
+	// by /stream unless it can read while responding.
+	MaxBodySize int64
+}
+
+// An HTTP server that keeps track of its connections, so that it can shut
+// down gracefully.
+type gracefulServer struct {
+	http.Server
+
+	mu    sync.Mutex
+	conns map[net.Conn]http.ConnState
+}
+
+func newGracefulServer(h http.Handler, cfg *serverConfig) *gracefulServer {
+	srv := &gracefulServer{conns: make(map[net.Conn]http.ConnState)}
+	srv.Handler = h
+	srv.ReadTimeout = cfg.ReadTimeout
+	srv.WriteTimeout = cfg.WriteTimeout
+	srv.ConnState = srv.trackConn
+	return srv
+}
+
+func (srv *gracefulServer) trackConn(c net.Conn, state http.ConnState) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	switch state {
+	case http.StateHijacked, http.StateClosed:
+		delete(srv.conns, c)
+	default:
+		srv.conns[c] = state
+	}
+}
+
+// Close connections that are not serving a request, or all of them if
+// force is set. Returns the number of connections left open.
+func (srv *gracefulServer) closeConns(force bool) int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for c, state := range srv.conns {
+		if force || state == http.StateIdle || state == http.StateNew {
+			c.Close()
+			delete(srv.conns, c)
+		}
+	}
+	return len(srv.conns)
+}
+
+// Serve HTTP on l until a value arrives on stop. Then stop accepting
+// connections and wait for in-flight requests to finish, up to timeout, and
+// close all connections.
+//
+// Returns the error from http.Server.Serve, if it stops by itself.
+func (srv *gracefulServer) serve(l net.Listener, stop <-chan os.Signal,
+	timeout time.Duration) error {
+
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Serve(l) }()
+
+	select {
+	case err := <-errc:
+		return err
+	case sig := <-stop:
+		log.Printf("received %v, shutting down", sig)
+	}
+
+	srv.SetKeepAlivesEnabled(false)
+	l.Close()
+	<-errc // Serve reports the closed listener; that's expected.
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		deadline = time.After(timeout)
+	}
+	tick := time.NewTicker(50 * time.Millisecond)
+	defer tick.Stop()
+	for srv.closeConns(false) > 0 {
+		select {
+		case <-tick.C:
+		case <-deadline:
+			log.Printf("closing %d connections after %v",
+				srv.closeConns(false), timeout)
+			srv.closeConns(true)
+			return nil
+		}
+	}
+	return nil
+}
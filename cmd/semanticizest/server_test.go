@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Start a server whose handler blocks until release is closed, and make a
+// request to it. Returns once the handler has been entered.
+func startBlocking(t *testing.T, timeout time.Duration) (stop chan os.Signal,
+	release chan struct{}, served, resp chan error) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entered := make(chan struct{})
+	release = make(chan struct{})
+	srv := newGracefulServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			close(entered)
+			<-release
+			w.Write([]byte("done"))
+		}), &serverConfig{})
+
+	stop = make(chan os.Signal, 1)
+	served = make(chan error, 1)
+	go func() { served <- srv.serve(l, stop, timeout) }()
+
+	resp = make(chan error, 1)
+	go func() {
+		r, err := http.Get("http://" + l.Addr().String() + "/")
+		if err == nil {
+			var body []byte
+			body, err = ioutil.ReadAll(r.Body)
+			r.Body.Close()
+			if err == nil && string(body) != "done" {
+				err = &httpError{"unexpected response " + string(body), 0}
+			}
+		}
+		resp <- err
+	}()
+
+	select {
+	case <-entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request didn't arrive")
+	}
+	return
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	stop, release, served, resp := startBlocking(t, 0)
+
+	stop <- syscall.SIGTERM
+	select {
+	case err := <-served:
+		t.Fatalf("server stopped during request: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-resp; err != nil {
+		t.Errorf("in-flight request failed: %v", err)
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server didn't stop")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	stop, release, served, resp := startBlocking(t, 50*time.Millisecond)
+	defer close(release)
+
+	stop <- os.Interrupt
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server didn't stop after timeout")
+	}
+	if err := <-resp; err == nil {
+		t.Error("expected request to be cut off")
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/semanticize/st/linking"
+)
+
+// Annotates a stream of documents. The request body is newline-delimited
+// JSON, one {"id": ..., "text": ...} object per document. The response is
+// likewise, one {"id": ..., "entities": [...]} object per document, in input
+// order, each flushed as soon as it's ready. A document that can't be
+// processed gets {"id": ..., "error": "..."} instead. Invalid JSON ends the
+// stream with an object holding only an error.
+//
+// Options are taken from the query string, as for /all; exactmatch=true
+// matches entire documents, as /exactmatch does.
+//
+// At most a few documents per CPU are in flight at any time. When the client
+// doesn't read the responses, the server stops reading documents.
+//
+// Reading documents while responding takes HTTP/2 or, for HTTP/1, Go 1.21 or
+// later. Otherwise, the documents are read before responding, up to maxBody
+// bytes.
+type streamHandler struct {
+	*linking.Semanticizer
+	maxBody int64
+}
+
+type streamResult struct {
+	ID       interface{}      `json:"id,omitempty"`
+	Entities []linking.Entity `json:"entities"` // null on error.
+	Error    string           `json:"error,omitempty"`
+}
+
+func (h streamHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	opts, err := parseOptions(req, h.Options())
+	var exact bool
+	if err == nil {
+		if v := req.URL.Query().Get("exactmatch"); v != "" {
+			exact, err = strconv.ParseBool(v)
+		}
+	}
+	if err != nil {
+		writeError(w, badRequest(err))
+		return
+	}
+	if !hasMediaType(req, true, "application/x-ndjson", "application/json",
+		"text/plain") {
+		writeError(w, unsupportedMediaType("application/x-ndjson"))
+		return
+	}
+
+	sem := h.WithOptions(opts)
+	method := linking.Semanticizer.All
+	if exact {
+		method = linking.Semanticizer.ExactMatch
+	}
+	method = observeDocs(recoverDocs(method))
+
+	var body io.Reader = req.Body
+	if !enableFullDuplex(w, req) {
+		data, err := readBody(w, req, h.maxBody)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		body = bytes.NewReader(data)
+	}
+
+	// Streams may last arbitrarily long, so the server's timeouts don't
+	// apply. Go versions without per-request deadlines leave them in place.
+	if rd, ok := w.(interface {
+		SetReadDeadline(time.Time) error
+	}); ok {
+		rd.SetReadDeadline(time.Time{})
+	}
+	if wd, ok := w.(interface {
+		SetWriteDeadline(time.Time) error
+	}); ok {
+		wd.SetWriteDeadline(time.Time{})
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		// Let the client know we're ready before the first result.
+		flusher.Flush()
+	}
+
+	// Results are queued in input order; the size of the queue bounds the
+	// number of documents in flight.
+	type pending struct {
+		done chan struct{}
+		res  streamResult
+	}
+	nworkers := runtime.GOMAXPROCS(0)
+	queue := make(chan *pending, 4*nworkers)
+	sema := make(chan struct{}, nworkers)
+	go func() {
+		defer close(queue)
+		dec := json.NewDecoder(body)
+		dec.UseNumber()
+		for {
+			var doc document
+			err := dec.Decode(&doc)
+			if err == io.EOF {
+				return
+			}
+
+			p := &pending{done: make(chan struct{})}
+			queue <- p
+			if err != nil {
+				p.res.Error = fmt.Sprintf("invalid JSON: %v", err)
+				close(p.done)
+				return
+			}
+
+			p.res.ID = doc.ID
+			sema <- struct{}{}
+			go func(text string) {
+				defer func() { <-sema }()
+				cands, err := method(sem, text)
+				if err != nil {
+					p.res.Error = err.Error()
+				} else {
+					if cands == nil {
+						cands = make([]linking.Entity, 0)
+					}
+					p.res.Entities = cands
+				}
+				close(p.done)
+			}(doc.Text)
+		}
+	}()
+
+	enc := json.NewEncoder(w)
+	for p := range queue {
+		<-p.done
+		if err := enc.Encode(&p.res); err != nil {
+			// Client went away. Drain the queue so the reader can finish.
+			for p = range queue {
+				<-p.done
+			}
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// Allow reading req's body after the response has started. HTTP/1 servers
+// normally close the body at that point; HTTP/2 always allows it.
+func enableFullDuplex(w http.ResponseWriter, req *http.Request) bool {
+	if req.ProtoMajor >= 2 {
+		return true
+	}
+	fd, ok := w.(interface {
+		EnableFullDuplex() error
+	})
+	return ok && fd.EnableFullDuplex() == nil
+}
@@ -2,26 +2,43 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
 	"html/template"
-	"io/ioutil"
+	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"sync"
 
 	"github.com/semanticize/st/internal/storage"
 	"github.com/semanticize/st/linking"
+	"github.com/semanticize/st/wikidump"
 )
 
 var infoTemplate = template.Must(template.New("info").Parse(`<html>
 <head><title>Semanticizest</title></head>
   <body>
     <h1>Semanticizest</h1>
+    {{with .Settings}}
   	<p>
       Serving <code>{{.Dumpname}}</code>
       with maximum n-gram length {{.MaxNGram}}.
     </p>
+    {{end}}
+    {{if .Models}}
+    <p>Models:
+      <ul>
+        {{range .Models}}<li><a href="/{{.}}/"><code>{{.}}</code></a></li>
+        {{end}}
+      </ul>
+      Select a model with a path prefix, e.g., <code>/{{index .Models 0}}/all</code>,
+      or a query parameter, e.g., <code>/all?model={{index .Models 0}}</code>.
+    </p>
+    {{end}}
     <p>Endpoints take data via POST requests and produce JSON:
       <ul>
         <li>
@@ -36,50 +53,399 @@ var infoTemplate = template.Must(template.New("info").Parse(`<html>
           <code>/exactmatch</code>
           gives all candidate entities for a string (but not its substrings)
         </li>
+        <li>
+          <code>/batch</code> does the same as <code>/all</code> for
+          many documents at once
+        </li>
+        <li>
+          <code>/stream</code> does the same for a stream of documents in
+          newline-delimited JSON, producing results as it goes
+        </li>
       </ul>
     </p>
+    <p>
+      Options are given as query parameters, e.g.,
+      <code>/all?nodisambig=true</code>. Instead of plain text, the body
+      can be JSON, with <code>Content-Type: application/json</code>:
+      <code>{"text": "...", "options": {"nodisambig": true}}</code>,
+      or for <code>/batch</code>,
+      <code>{"documents": [{"id": 1, "text": "..."}], "options": {}}</code>.
+    </p>
+    <p>
+      <code>/entity?title=...</code> describes the article with the given
+      title.
+    </p>
+    <p>
+      <code>/info</code> describes the model in JSON.
+      <code>/healthz</code> reports that the server is up and
+      <code>/readyz</code> that the model can be queried (status 503 if not).
+      <code>/metrics</code> reports statistics in the Prometheus text format.
+    </p>
     <p>&copy; 2015 Netherlands eScience Center/University of Amsterdam.</p>
   </body>
 </html>`))
 
-func info(w http.ResponseWriter, settings *storage.Settings) {
-	infoTemplate.Execute(w, settings)
+// Serve the info page, describing the model with the given settings (if
+// any) and listing the models available (if there are several).
+func info(w http.ResponseWriter, req *http.Request,
+	settings *storage.Settings, models []string) {
+
+	// "/" matches everything not matched by other handlers.
+	if req.URL.Path != "/" {
+		writeError(w, newError(http.StatusNotFound, "no such endpoint: %s",
+			req.URL.Path))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if len(models) < 2 {
+		models = nil
+	}
+	infoTemplate.Execute(w, struct {
+		Settings *storage.Settings
+		Models   []string
+	}{settings, models})
 }
 
-type allHandler struct{ *linking.Semanticizer }
+// Handlers that read a request body take the largest body they accept.
+type allHandler struct {
+	*linking.Semanticizer
+	maxBody int64
+}
 
 func (h allHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	serveEntities(w, req, h.All)
+	serveEntities(w, req, h.Semanticizer, h.maxBody, linking.Semanticizer.All)
 }
 
-type stringHandler struct{ *linking.Semanticizer }
+type stringHandler struct {
+	*linking.Semanticizer
+	maxBody int64
+}
 
 func (h stringHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	serveEntities(w, req, h.ExactMatch)
+	serveEntities(w, req, h.Semanticizer, h.maxBody,
+		linking.Semanticizer.ExactMatch)
 }
 
-func serveEntities(w http.ResponseWriter, req *http.Request,
-	method func(string) ([]linking.Entity, error)) {
+// Looks up an article by title. The title is normalized with the case rule
+// of the wiki the model was built from, as MediaWiki does.
+type entityHandler struct {
+	*linking.Semanticizer
+	siteinfo *wikidump.SiteInfo
+}
+
+func (h entityHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	title := h.siteinfo.NormalizeTitle(req.URL.Query().Get("title"))
+	if title == "" {
+		writeError(w, newError(http.StatusBadRequest, "no title given"))
+		return
+	}
+
+	e, err := h.Lookup(title)
+	if err != nil {
+		writeError(w, linkingError(err))
+		return
+	} else if e == nil {
+		writeError(w, newError(http.StatusNotFound, "no entity %q", title))
+		return
+	}
+	writeJSON(w, e)
+}
+
+// Parse options from the query string of req, starting from opts.
+//
+// We don't use req.FormValue, because that would consume the body of a
+// form-encoded POST request (as sent by curl -d).
+func parseOptions(req *http.Request, opts linking.Options) (linking.Options,
+	error) {
+
+	return parseValues(req.URL.Query(), opts)
+}
+
+// Parse options from query, starting from opts. Unknown options are ignored.
+func parseValues(query url.Values, opts linking.Options) (linking.Options,
+	error) {
+
+	for _, p := range []struct {
+		name string
+		dst  *bool
+	}{
+		{"titles", &opts.TitleAnchors},
+		{"aliases", &opts.Aliases},
+		{"nodisambig", &opts.ExcludeDisambiguation},
+		{"expanddisambig", &opts.ExpandDisambiguation},
+		{"dropuntranslated", &opts.DropUntranslated},
+		{"showcategories", &opts.ShowCategories},
+		{"description", &opts.Descriptions},
+	} {
+		if v := query.Get(p.name); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return opts, fmt.Errorf("invalid value for %s: %q", p.name, v)
+			}
+			*p.dst = b
+		}
+	}
+	if lang, ok := query["lang"]; ok {
+		opts.Lang = lang[0]
+	}
+	if cats, ok := query["category"]; ok {
+		opts.Categories = cats
+	}
+	if v := query.Get("categorydepth"); v != "" {
+		depth, err := strconv.Atoi(v)
+		if err != nil || depth < 0 {
+			return opts, fmt.Errorf("invalid value for categorydepth: %q", v)
+		}
+		opts.CategoryDepth = depth
+	}
+	return opts, nil
+}
+
+// Body of a JSON request to /all, /exactmatch or /batch. The first two take
+// a single Text, /batch takes Documents.
+//
+// Options have the same names and meaning as the query parameters, e.g.,
+// {"nodisambig": true, "category": ["Physicists"]}. They override the query
+// parameters.
+type jsonRequest struct {
+	Text      string                 `json:"text"`
+	Documents []document             `json:"documents"`
+	Options   map[string]interface{} `json:"options"`
+}
+
+type document struct {
+	ID   interface{} `json:"id"` // String or number.
+	Text string      `json:"text"`
+}
 
-	text, err := ioutil.ReadAll(req.Body)
+// Read a JSON request from req's body, of at most max bytes.
+func readJSON(w http.ResponseWriter, req *http.Request,
+	max int64) (r jsonRequest, err error) {
+
+	dec := json.NewDecoder(limitBody(w, req, max))
+	dec.UseNumber()
+	if err = dec.Decode(&r); err != nil {
+		if tooLarge(err) {
+			return r, readError(err, max)
+		}
+		err = newError(http.StatusBadRequest, "invalid JSON request: %v", err)
+	}
+	return
+}
+
+// Apply the options from a JSON request, as if they were query parameters.
+func jsonOptions(options map[string]interface{},
+	opts linking.Options) (linking.Options, error) {
+
+	values := make(url.Values)
+	for name, v := range options {
+		switch v := v.(type) {
+		case nil:
+		case []interface{}:
+			for _, elem := range v {
+				values.Add(name, fmt.Sprint(elem))
+			}
+		default:
+			values.Set(name, fmt.Sprint(v))
+		}
+	}
+	return parseValues(values, opts)
+}
+
+// Parse the options and text of a request for a single text. The text is
+// either the entire body, or, for a JSON request, the "text" member.
+func parseRequest(w http.ResponseWriter, req *http.Request,
+	sem *linking.Semanticizer, maxBody int64) (opts linking.Options,
+	text string, err error) {
+
+	opts, err = parseOptions(req, sem.Options())
+	if err != nil {
+		return opts, "", badRequest(err)
+	}
+	if isJSON(req) {
+		var r jsonRequest
+		if r, err = readJSON(w, req, maxBody); err != nil {
+			return
+		}
+		text = r.Text
+		if opts, err = jsonOptions(r.Options, opts); err != nil {
+			return opts, "", badRequest(err)
+		}
+	} else {
+		var body []byte
+		if body, err = readBody(w, req, maxBody); err != nil {
+			return
+		}
+		text = string(body)
+	}
 	if len(text) == 0 {
-		err = errors.New("received no data")
+		err = newError(http.StatusBadRequest, "received no data")
 	}
+	return
+}
+
+func serveEntities(w http.ResponseWriter, req *http.Request,
+	sem *linking.Semanticizer, maxBody int64,
+	method func(linking.Semanticizer, string) ([]linking.Entity, error)) {
+
+	opts, text, err := parseRequest(w, req, sem, maxBody)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 
-	cands, err := method(string(text))
+	cands, err := observeDocs(method)(sem.WithOptions(opts), text)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, linkingError(err))
+		return
 	}
 	if cands == nil {
 		// Report "[]" to caller, not "null".
 		cands = make([]linking.Entity, 0)
 	}
+	writeJSON(w, cands)
+}
+
+// Annotates a batch of documents, given as a JSON request, concurrently.
+// Responds with {"results": {id: entities, ...}}. Takes the same options as
+// /all; set "exactmatch" to true to match entire documents, as /exactmatch
+// does.
+type batchHandler struct {
+	*linking.Semanticizer
+	maxBody int64
+}
+
+func (h batchHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	sem, exact, ids, texts, err := parseBatch(w, req, h.Semanticizer,
+		h.maxBody)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	method := linking.Semanticizer.All
+	if exact {
+		method = linking.Semanticizer.ExactMatch
+	}
+	cands, err := annotate(sem, method, texts)
+	if err != nil {
+		writeError(w, linkingError(err))
+		return
+	}
 
-	json.NewEncoder(w).Encode(cands)
+	results := make(map[string][]linking.Entity, len(ids))
+	for i, id := range ids {
+		results[id] = cands[i]
+	}
+	writeJSON(w, struct {
+		Results map[string][]linking.Entity `json:"results"`
+	}{results})
+}
+
+// Parse a batch request. Returns a Semanticizer with the requested options,
+// whether to use ExactMatch, and the ids and texts of the documents.
+func parseBatch(w http.ResponseWriter, req *http.Request,
+	sem *linking.Semanticizer, maxBody int64) (s linking.Semanticizer,
+	exact bool, ids, texts []string, err error) {
+
+	if !isJSON(req) {
+		err = unsupportedMediaType("application/json")
+		return
+	}
+	opts, err := parseOptions(req, sem.Options())
+	if err != nil {
+		err = badRequest(err)
+		return
+	}
+	r, err := readJSON(w, req, maxBody)
+	if err != nil {
+		return
+	}
+	if opts, err = jsonOptions(r.Options, opts); err != nil {
+		err = badRequest(err)
+		return
+	}
+	exact, _ = r.Options["exactmatch"].(bool)
+
+	seen := make(map[string]bool, len(r.Documents))
+	for i, doc := range r.Documents {
+		var id string
+		switch v := doc.ID.(type) {
+		case string:
+			id = v
+		case json.Number:
+			id = v.String()
+		default:
+			err = newError(http.StatusBadRequest,
+				"document %d: id must be a string or number", i)
+			return
+		}
+		if seen[id] {
+			err = newError(http.StatusBadRequest,
+				"duplicate document id %q", id)
+			return
+		}
+		seen[id] = true
+		ids, texts = append(ids, id), append(texts, doc.Text)
+	}
+	return sem.WithOptions(opts), exact, ids, texts, nil
+}
+
+// Apply method to texts concurrently. Returns the candidates for each text,
+// never nil, or the first error encountered.
+func annotate(sem linking.Semanticizer,
+	method func(linking.Semanticizer, string) ([]linking.Entity, error),
+	texts []string) (cands [][]linking.Entity, err error) {
+
+	cands = make([][]linking.Entity, len(texts))
+	errs := make([]error, len(texts))
+	method = observeDocs(recoverDocs(method))
+
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for j := 0; j < runtime.GOMAXPROCS(0); j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				cands[i], errs[i] = method(sem, texts[i])
+				if cands[i] == nil {
+					cands[i] = make([]linking.Entity, 0)
+				}
+			}
+		}()
+	}
+	for i := range texts {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	for _, err = range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cands, nil
+}
+
+// Wrap method to turn a panic into an error for the document that caused it.
+// net/http only recovers panics in the goroutine serving a request, so a
+// panic in a worker would take down the server.
+func recoverDocs(method func(linking.Semanticizer, string) ([]linking.Entity,
+	error)) func(linking.Semanticizer, string) ([]linking.Entity, error) {
+
+	return func(sem linking.Semanticizer, s string) (cands []linking.Entity,
+		err error) {
+
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("panic while annotating: %v\n%s", r, debug.Stack())
+				cands, err = nil, fmt.Errorf("internal error: %v", r)
+			}
+		}()
+		return method(sem, s)
+	}
 }
 
 // Determine actual port used by l and write it to path (followed by a newline).
@@ -100,14 +466,30 @@ func writePort(l net.Listener, path string) (err error) {
 	return
 }
 
-func restServer(addr, portfile string, sem *linking.Semanticizer,
-	s *storage.Settings) (err error) {
+// Routes for the REST API for a single model. models lists the names of all
+// the models being served; maxBody is the largest request body accepted.
+func newMux(sem *linking.Semanticizer, s *storage.Settings, models []string,
+	maxBody int64) *http.ServeMux {
 
-	http.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
-		info(w, s)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		info(w, req, s, models)
 	})
-	http.Handle("/all", allHandler{sem})
-	http.Handle("/exactmatch", stringHandler{sem})
+	mux.Handle("/all", allHandler{sem, maxBody})
+	mux.Handle("/exactmatch", stringHandler{sem, maxBody})
+	mux.Handle("/entity", entityHandler{sem, &wikidump.SiteInfo{Case: s.Case}})
+	mux.Handle("/batch", batchHandler{sem, maxBody})
+	mux.Handle("/stream", streamHandler{sem, maxBody})
+	mux.Handle("/readyz", readyHandler{sem})
+	mux.Handle("/info", modelInfoHandler{sem, s, models})
+	return mux
+}
+
+// Serve the REST API for models on addr until a signal arrives on stop,
+// then shut down gracefully. The caller is responsible for closing models
+// afterwards.
+func restServer(addr, portfile string, models *modelSet, cfg *serverConfig,
+	stop <-chan os.Signal) (err error) {
 
 	l, err := net.Listen("tcp", addr)
 	if err != nil {
@@ -121,5 +503,6 @@ func restServer(addr, portfile string, sem *linking.Semanticizer,
 		}
 	}
 
-	return http.Serve(l, nil)
+	srv := newGracefulServer(router{models, cfg.AdminToken}, cfg)
+	return srv.serve(l, stop, cfg.ShutdownTimeout)
 }
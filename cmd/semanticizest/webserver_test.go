@@ -0,0 +1,453 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/semanticize/st/hash"
+	"github.com/semanticize/st/hash/countmin"
+	"github.com/semanticize/st/internal/storage"
+	"github.com/semanticize/st/linking"
+	"github.com/semanticize/st/wikidump"
+)
+
+// Builds a model in which "Mercury" links to two planets and an element, and
+// "Venus" to one planet.
+func testModel(t *testing.T) (sem *linking.Semanticizer, path string) {
+	f, err := ioutil.TempFile("", "semanticizest-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path = f.Name()
+	f.Close()
+
+	db, err := storage.MakeDB(path, true,
+		&storage.Settings{Dumpname: "testwiki", MaxNGram: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mercury := hash.NGrams([]string{"Mercury"}, 1, 1)[0]
+	venus := hash.NGrams([]string{"Venus"}, 1, 1)[0]
+	cm, _ := countmin.New(4, 64)
+	cm.Add(mercury, 20)
+	cm.Add(venus, 10)
+	for _, q := range []string{
+		`insert into titles values (1, "Mercury (planet)"),
+		                           (2, "Mercury (element)"), (3, "Venus")`,
+		`insert into pages (titleid, pageid, length, disambiguation)
+		 values (1, 10, 100, 0), (2, 20, 100, 0), (3, 30, 100, 0)`,
+	} {
+		if _, err = db.Exec(q); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		_, err = db.Exec(`insert into linkstats (ngramhash, targetid, count)
+		                  values (?, 1, 6), (?, 2, 4), (?, 3, 5)`,
+			mercury, mercury, venus)
+	}
+	if err == nil {
+		err = storage.StoreCM(db, cm)
+	}
+	if err == nil {
+		err = db.Close()
+	}
+	if err == nil {
+		sem, _, err = linking.Load(path)
+	}
+	if err != nil {
+		os.Remove(path)
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestBatch(t *testing.T) {
+	sem, path := testModel(t)
+	defer os.Remove(path)
+
+	const body = `{"documents": [
+		{"id": "a", "text": "Mercury and Venus"},
+		{"id": 2, "text": "Venus"},
+		{"id": "c", "text": "nothing"}]}`
+	req, _ := http.NewRequest("POST", "/batch", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	batchHandler{sem, defaultMaxBodySize}.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+
+	var resp struct {
+		Results map[string][]linking.Entity
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	for id, n := range map[string]int{"a": 3, "2": 1, "c": 0} {
+		cands, ok := resp.Results[id]
+		if !ok {
+			t.Errorf("no results for document %q", id)
+		} else if len(cands) != n {
+			t.Errorf("expected %d candidates for %q, got %v", n, id, cands)
+		}
+	}
+
+	for _, body := range []string{
+		`{"documents": [{"id": 1, "text": "a"}, {"id": 1, "text": "b"}]}`,
+		`{"documents": [{"text": "no id"}]}`,
+		`{"documents": [], "options": {"categorydepth": -1}}`,
+		`not JSON`,
+	} {
+		req, _ := http.NewRequest("POST", "/batch", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		batchHandler{sem, defaultMaxBodySize}.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400 for %s, got %d", body, w.Code)
+		}
+	}
+
+	// Documents without tokens have no exact matches.
+	req, _ = http.NewRequest("POST", "/batch", strings.NewReader(
+		`{"documents": [{"id": "empty", "text": ""}, {"id": "punct",
+		  "text": " ?! "}], "options": {"exactmatch": true}}`))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	batchHandler{sem, defaultMaxBodySize}.ServeHTTP(w, req)
+	resp.Results = nil
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d: %s", w.Code, w.Body)
+	} else if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Error(err)
+	}
+	for _, id := range []string{"empty", "punct"} {
+		if cands, ok := resp.Results[id]; !ok || len(cands) != 0 {
+			t.Errorf("expected no candidates for %q, got %v", id, cands)
+		}
+	}
+
+	// A panic while annotating is reported as an error.
+	_, err := annotate(*sem, func(linking.Semanticizer,
+		string) ([]linking.Entity, error) {
+		panic("oops")
+	}, []string{"Mercury"})
+	if err == nil || !strings.Contains(err.Error(), "oops") {
+		t.Errorf("expected error for panic, got %v", err)
+	}
+}
+
+func TestJSONRequest(t *testing.T) {
+	sem, path := testModel(t)
+	defer os.Remove(path)
+
+	for _, c := range []struct {
+		contentType, body string
+		ncands            int
+	}{
+		{"text/plain", "Mercury", 2},
+		{"application/json", `{"text": "Mercury"}`, 2},
+		{"application/json; charset=utf-8",
+			`{"text": "Mercury Venus", "options": {"lang": "fr",
+			  "dropuntranslated": true}}`, 0},
+	} {
+		req, _ := http.NewRequest("POST", "/all", strings.NewReader(c.body))
+		req.Header.Set("Content-Type", c.contentType)
+		w := httptest.NewRecorder()
+		allHandler{sem, defaultMaxBodySize}.ServeHTTP(w, req)
+
+		var cands []linking.Entity
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200 for %s, got %d", c.body, w.Code)
+		} else if err := json.Unmarshal(w.Body.Bytes(), &cands); err != nil {
+			t.Error(err)
+		} else if len(cands) != c.ncands {
+			t.Errorf("expected %d candidates for %s, got %v",
+				c.ncands, c.body, cands)
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	// Through the router, to check that instrument passes on flushes.
+	set, cleanup := testModels(t, "test")
+	defer cleanup()
+	server := httptest.NewServer(router{set, ""})
+	defer server.Close()
+
+	// Send documents one by one, reading each result before sending the
+	// next, to check that results arrive incrementally.
+	pr, pw := io.Pipe()
+	resp, err := http.Post(server.URL+"/stream?nodisambig=true",
+		"application/x-ndjson", pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+	dec := json.NewDecoder(resp.Body)
+	next := func() (res map[string]interface{}) {
+		if err := dec.Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	// http.Post only returns once the response headers arrive; the server
+	// sends those before reading any documents.
+	for i, c := range []struct {
+		doc      string
+		entities int
+	}{
+		{`{"id": 1, "text": "Mercury"}`, 2},
+		{`{"id": "b", "text": "nothing here"}`, 0},
+		{`{"id": 3, "text": "Venus"}`, 1},
+	} {
+		if _, err = io.WriteString(pw, c.doc+"\n"); err != nil {
+			t.Fatal(err)
+		}
+		res := next()
+		if ents, ok := res["entities"].([]interface{}); !ok {
+			t.Errorf("no entities in result %d: %v", i, res)
+		} else if len(ents) != c.entities {
+			t.Errorf("expected %d entities in result %d, got %v",
+				c.entities, i, res)
+		}
+	}
+
+	io.WriteString(pw, "{bad json\n")
+	if res := next(); res["error"] == nil {
+		t.Errorf("expected error for invalid JSON, got %v", res)
+	}
+	pw.Close()
+	if err = dec.Decode(new(interface{})); err != io.EOF {
+		t.Errorf("expected end of stream, got %v", err)
+	}
+
+	// Without full duplex, all documents are read before responding.
+	m := set.models["test"].acquire()
+	defer m.release()
+	w := httptest.NewRecorder()
+	stream := streamHandler{m.sem, defaultMaxBodySize}
+	stream.ServeHTTP(w, newRequest("POST", "/stream", "",
+		`{"id": 1, "text": "Mercury"}`+"\n"+`{"id": 2, "text": "Venus"}`))
+	if n := strings.Count(w.Body.String(), `"entities":[{`); w.Code != 200 ||
+		n != 2 {
+		t.Errorf("expected two results, got %d: %s", w.Code, w.Body)
+	}
+
+	// Documents without tokens have no exact matches; the stream goes on.
+	w = httptest.NewRecorder()
+	stream.ServeHTTP(w, newRequest("POST",
+		"/stream?exactmatch=true", "", `{"id": 1, "text": ""}`+"\n"+
+			`{"id": 2, "text": " ?! "}`+"\n"+`{"id": 3, "text": "Venus"}`))
+	if w.Code != 200 || strings.Contains(w.Body.String(), `"error"`) ||
+		strings.Count(w.Body.String(), `"entities":[]`) != 2 ||
+		strings.Count(w.Body.String(), `"entities":[{`) != 1 {
+		t.Errorf("wrong results for exact matches: %d: %s", w.Code, w.Body)
+	}
+}
+
+// Serve req with h and check that the response is a JSON error with the given
+// status, and nothing else.
+func checkError(t *testing.T, h http.Handler, req *http.Request, status int) {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != status {
+		t.Errorf("%s %s: expected status %d, got %d: %s",
+			req.Method, req.URL, status, w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct,
+		"application/json") {
+		t.Errorf("%s %s: wrong Content-Type %q", req.Method, req.URL, ct)
+	}
+
+	dec := json.NewDecoder(w.Body)
+	var e struct {
+		Error  string
+		Status int
+	}
+	if err := dec.Decode(&e); err != nil {
+		t.Errorf("%s %s: %v", req.Method, req.URL, err)
+	} else if e.Error == "" || e.Status != status {
+		t.Errorf("%s %s: wrong error %+v", req.Method, req.URL, e)
+	}
+	if err := dec.Decode(new(interface{})); err != io.EOF {
+		t.Errorf("%s %s: more output after error", req.Method, req.URL)
+	}
+}
+
+func newRequest(method, url, contentType, body string) *http.Request {
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return req
+}
+
+func TestErrors(t *testing.T) {
+	sem, path := testModel(t)
+	defer os.Remove(path)
+
+	const maxBody = 100
+	long := strings.Repeat("Mercury ", 20)
+
+	all, exact := allHandler{sem, maxBody}, stringHandler{sem, maxBody}
+	entity := entityHandler{sem, wikidump.DefaultSiteInfo}
+	batch, stream := batchHandler{sem, maxBody}, streamHandler{sem, maxBody}
+	infoPage := http.HandlerFunc(func(w http.ResponseWriter,
+		req *http.Request) {
+
+		info(w, req, &storage.Settings{}, nil)
+	})
+
+	for _, c := range []struct {
+		h      http.Handler
+		req    *http.Request
+		status int
+	}{
+		{all, newRequest("POST", "/all", "text/plain", ""), 400},
+		{all, newRequest("POST", "/all?titles=maybe", "", "Mercury"), 400},
+		{all, newRequest("POST", "/all?categorydepth=-1", "", "Mercury"), 400},
+		{all, newRequest("POST", "/all", "application/json", `{"text":`), 400},
+		{all, newRequest("POST", "/all", "application/json",
+			`{"text": "Mercury", "options": {"aliases": "maybe"}}`), 400},
+		{all, newRequest("POST", "/all", "text/plain", long), 413},
+		{all, newRequest("POST", "/all", "application/json",
+			`{"text": "`+long+`"}`), 413},
+		{exact, newRequest("POST", "/exactmatch", "", ""), 400},
+		{entity, newRequest("GET", "/entity", "", ""), 400},
+		{entity, newRequest("GET", "/entity?title=Pluto", "", ""), 404},
+		{batch, newRequest("POST", "/batch", "text/plain", "Mercury"), 415},
+		{batch, newRequest("POST", "/batch", "application/json",
+			`{"documents": [{"id": 1, "text": "`+long+`"}]}`), 413},
+		{stream, newRequest("POST", "/stream", "image/png", ""), 415},
+		{stream, newRequest("POST", "/stream?exactmatch=no", "", ""), 400},
+		// httptest.ResponseRecorder can't do full duplex, so the body is
+		// read up front, within the limit.
+		{stream, newRequest("POST", "/stream", "",
+			`{"id": 1, "text": "`+long+`"}`), 413},
+		{infoPage, newRequest("GET", "/nonexistent", "", ""), 404},
+	} {
+		checkError(t, c.h, c.req, c.status)
+	}
+
+	// Without a model, all handlers report 503.
+	if err := sem.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		h   http.Handler
+		req *http.Request
+	}{
+		{all, newRequest("POST", "/all", "", "Mercury")},
+		{exact, newRequest("POST", "/exactmatch", "", "Mercury")},
+		{entity, newRequest("GET", "/entity?title=Venus", "", "")},
+		{batch, newRequest("POST", "/batch", "application/json",
+			`{"documents": [{"id": 1, "text": "Mercury"}]}`)},
+	} {
+		checkError(t, c.h, c.req, 503)
+	}
+}
+
+func TestHandlers(t *testing.T) {
+	sem, path := testModel(t)
+	defer os.Remove(path)
+	all := allHandler{sem, defaultMaxBodySize}
+	exact := stringHandler{sem, defaultMaxBodySize}
+
+	for _, c := range []struct {
+		h        http.Handler
+		req      *http.Request
+		expected string // Substring of response.
+	}{
+		{all, newRequest("POST", "/all", "", "Mercury rising"),
+			`"target":"Mercury (element)"`},
+		{exact, newRequest("POST", "/exactmatch", "", "Mercury rising"), `[]`},
+		{exact, newRequest("POST", "/exactmatch", "", "Venus"),
+			`"target":"Venus"`},
+		{entityHandler{sem, wikidump.DefaultSiteInfo}, newRequest("GET",
+			"/entity?title=mercury_(planet)", "", ""), `"pageid":10`},
+	} {
+		w := httptest.NewRecorder()
+		c.h.ServeHTTP(w, c.req)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: expected status 200, got %d: %s",
+				c.req.URL, w.Code, w.Body)
+		}
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct,
+			"application/json") {
+			t.Errorf("%s: wrong Content-Type %q", c.req.URL, ct)
+		}
+		if body := w.Body.String(); !strings.Contains(body, c.expected) {
+			t.Errorf("%s: expected %s in response, got %s",
+				c.req.URL, c.expected, body)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	info(w, newRequest("GET", "/", "", ""), &storage.Settings{
+		Dumpname: "testwiki", MaxNGram: 2}, nil)
+	if w.Code != http.StatusOK ||
+		!strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") ||
+		!strings.Contains(w.Body.String(), "testwiki") {
+		t.Errorf("wrong info page: %d %v %s", w.Code, w.Header(), w.Body)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	sem, path := testModel(t)
+	defer os.Remove(path)
+	mux := newMux(sem, &storage.Settings{Dumpname: "testwiki", MaxNGram: 2},
+		[]string{"test"}, defaultMaxBodySize)
+
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, newRequest("GET", url, "", ""))
+		return w
+	}
+
+	if w := get("/readyz"); w.Code != http.StatusOK {
+		t.Errorf("/readyz: expected status 200, got %d: %s", w.Code, w.Body)
+	}
+
+	w := get("/info")
+	var info struct {
+		Models   []string
+		Settings storage.Settings
+		Tables   map[string]int64
+		Sketch   struct{ Rows, Cols int }
+	}
+	if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Settings.Dumpname != "testwiki" || info.Settings.MaxNGram != 2 ||
+		len(info.Models) != 1 || info.Models[0] != "test" {
+		t.Errorf("wrong settings in %+v", info)
+	}
+	if info.Tables["titles"] != 3 || info.Tables["linkstats"] != 3 {
+		t.Errorf("wrong table sizes %v", info.Tables)
+	}
+	if info.Sketch.Rows == 0 || info.Sketch.Cols == 0 {
+		t.Errorf("wrong sketch size in %+v", info)
+	}
+
+	sem.Close()
+	w = httptest.NewRecorder()
+	healthz(w, newRequest("GET", "/healthz", "", ""))
+	if w.Code != http.StatusOK {
+		t.Errorf("/healthz: expected status 200 after close, got %d", w.Code)
+	}
+	checkError(t, mux, newRequest("GET", "/readyz", "", ""), 503)
+	// Table sizes are counted at load time, so /info doesn't need the model.
+	if w := get("/info"); w.Code != http.StatusOK {
+		t.Errorf("/info: expected status 200 after close, got %d", w.Code)
+	}
+}
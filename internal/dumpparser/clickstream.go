@@ -0,0 +1,84 @@
+package dumpparser
+
+import (
+	"hash/fnv"
+	"io"
+
+	"github.com/semanticize/st/internal/storage"
+	"github.com/semanticize/st/wikidump"
+)
+
+// Joins clickstream counts with the links in articles, to estimate how often
+// readers follow links with a given anchor to a given target.
+//
+// The clicks from one article to another are divided over the links between
+// them in proportion to their frequency. Clickstream dumps record the
+// article that a link leads to after following redirects, so the redirects
+// must be known before the articles are joined.
+//
+// Safe for concurrent use by the workers in processPages, once read is done.
+type clickJoiner struct {
+	clicks map[uint64]int64  // clickKey(source, target) -> clicks
+	final  map[string]string // Redirect -> final target, or "".
+}
+
+func newClickJoiner(redirects []wikidump.Redirect) *clickJoiner {
+	final, _ := storage.ResolveRedirects(redirects)
+	return &clickJoiner{clicks: make(map[uint64]int64), final: final}
+}
+
+// Hash of a (source, target) pair. Keeps the clickstream, which has tens of
+// millions of pairs for the larger Wikipedias, from taking up gigabytes of
+// memory in titles. Collisions are improbable enough to ignore.
+func clickKey(source, target string) uint64 {
+	h := fnv.New64a()
+	io.WriteString(h, source)
+	h.Write([]byte{0})
+	io.WriteString(h, target)
+	return h.Sum64()
+}
+
+// Add the link clicks in a clickstream dump. Returns the number of (source,
+// target) pairs read.
+func (cj *clickJoiner) read(r io.Reader) (n int, err error) {
+	err = wikidump.ReadClickstream(r, "link",
+		func(from, to string, clicks int64) error {
+			cj.clicks[clickKey(from, to)] += clicks
+			n++
+			return nil
+		})
+	return
+}
+
+// Returns the article that target leads to, following redirects.
+func (cj *clickJoiner) target(target string) string {
+	if final, ok := cj.final[target]; ok {
+		return final
+	}
+	return target
+}
+
+// Credit the clicks from source to the links in it: the clicks to each
+// target are divided over the links that lead to it, in proportion to their
+// frequency, and added to linkagg as pseudo-links.
+func (cj *clickJoiner) join(source string, links map[wikidump.Link]int,
+	linkagg *linkAggregator, maxN int) {
+
+	total := make(map[string]int, len(links))
+	for link, freq := range links {
+		total[cj.target(link.Target)] += freq
+	}
+	for link, freq := range links {
+		target := cj.target(link.Target)
+		if target == "" {
+			continue // Broken redirect.
+		}
+		clicks, ok := cj.clicks[clickKey(source, target)]
+		if !ok {
+			continue
+		}
+		count := float64(clicks) * float64(freq) / float64(total[target])
+		linkagg.add(processAnchor(link.Anchor, link.Target, count,
+			anchorClick, maxN))
+	}
+}
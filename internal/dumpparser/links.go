@@ -0,0 +1,389 @@
+package dumpparser
+
+import (
+	"bufio"
+	"container/heap"
+	"database/sql"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Maximum number of (n-gram hash, target) pairs kept in memory by a
+// linkAggregator before it starts spilling sorted runs to disk.
+var maxLinksInMemory = 1 << 22
+
+// Link counts are accumulated in fixed point with this many fractional bits.
+// Unlike floating-point addition, integer addition is associative, so the
+// totals don't depend on the order in which workers report links.
+const countFracBits = 32
+
+func toFixed(count float64) int64 {
+	return int64(count*(1<<countFracBits) + .5)
+}
+
+func fromFixed(count int64) float64 {
+	return float64(count) / (1 << countFracBits)
+}
+
+// Number of shards in a linkAggregator. Workers only contend for a shard's
+// lock when they see the same n-gram hash modulo this number.
+const nLinkShards = 64
+
+type linkKey struct {
+	target string
+	hash   uint32
+}
+
+func (k linkKey) less(l linkKey) bool {
+	if k.target != l.target {
+		return k.target < l.target
+	}
+	return k.hash < l.hash
+}
+
+// Counts per anchorKind, in fixed point (see countFracBits).
+type linkCounts [nAnchorKinds]int64
+
+type linkEntry struct {
+	linkKey
+	counts linkCounts
+}
+
+type byTargetHash []linkEntry
+
+func (s byTargetHash) Len() int           { return len(s) }
+func (s byTargetHash) Less(i, j int) bool { return s[i].less(s[j].linkKey) }
+func (s byTargetHash) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+type linkShard struct {
+	sync.Mutex
+	counts map[linkKey]linkCounts
+}
+
+// Aggregates link counts per (n-gram hash, target) pair in memory, so that
+// each pair becomes a single row in the linkstats table.
+//
+// Safe for concurrent use by multiple workers. When a shard grows beyond its
+// share of maxLinksInMemory, it is sorted and written to a temporary file;
+// store merges these runs with what's left in memory.
+type linkAggregator struct {
+	shards   [nLinkShards]linkShard
+	maxShard int
+
+	mu     sync.Mutex // Protects the fields below.
+	tmpdir string
+	runs   []string
+	err    error
+}
+
+func newLinkAggregator(maxInMemory int) *linkAggregator {
+	agg := &linkAggregator{maxShard: maxInMemory / nLinkShards}
+	if agg.maxShard < 1 {
+		agg.maxShard = 1
+	}
+	for i := range agg.shards {
+		agg.shards[i].counts = make(map[linkKey]linkCounts)
+	}
+	return agg
+}
+
+// Add the counts for all of link's anchor hashes.
+func (agg *linkAggregator) add(link *processedLink) {
+	count := toFixed(link.freq)
+	for _, h := range link.anchorHashes {
+		shard := &agg.shards[h%nLinkShards]
+		key := linkKey{link.target, h}
+		shard.Lock()
+		counts := shard.counts[key]
+		counts[link.kind] += count
+		shard.counts[key] = counts
+		if len(shard.counts) > agg.maxShard {
+			agg.spill(shard)
+		}
+		shard.Unlock()
+	}
+}
+
+// Write the contents of shard to a sorted run on disk and empty it.
+// Must be called with shard locked.
+//
+// Errors are recorded in agg and reported by store.
+func (agg *linkAggregator) spill(shard *linkShard) {
+	entries := sortedEntries(shard.counts)
+	shard.counts = make(map[linkKey]linkCounts)
+
+	agg.mu.Lock()
+	defer agg.mu.Unlock()
+	if agg.err != nil {
+		return
+	}
+	if agg.tmpdir == "" {
+		agg.tmpdir, agg.err = ioutil.TempDir("", "semanticizest-links")
+		if agg.err != nil {
+			return
+		}
+	}
+	path := filepath.Join(agg.tmpdir, strconv.Itoa(len(agg.runs)))
+	if agg.err = writeRun(path, entries); agg.err == nil {
+		agg.runs = append(agg.runs, path)
+	}
+}
+
+func sortedEntries(counts map[linkKey]linkCounts) []linkEntry {
+	entries := make([]linkEntry, 0, len(counts))
+	for k, c := range counts {
+		entries = append(entries, linkEntry{k, c})
+	}
+	sort.Sort(byTargetHash(entries))
+	return entries
+}
+
+// Store the aggregated counts in the titles and linkstats tables, in sorted
+// order of target, then hash. Targets get consecutive ids, starting after
+// the largest id already present in titles.
+//
+// Must be called after all calls to add have returned.
+func (agg *linkAggregator) store(db *sql.DB) (err error) {
+	if agg.err != nil {
+		return agg.err
+	}
+
+	streams := make([]linkStream, 0, len(agg.runs)+nLinkShards)
+	for _, path := range agg.runs {
+		var r *runReader
+		r, err = openRun(path)
+		if err != nil {
+			return
+		}
+		defer r.Close()
+		streams = append(streams, r)
+	}
+	for i := range agg.shards {
+		entries := sortedEntries(agg.shards[i].counts)
+		agg.shards[i].counts = nil
+		streams = append(streams, &sliceStream{entries})
+	}
+
+	var id int64
+	err = db.QueryRow(`select coalesce(max(id), 0) from titles`).Scan(&id)
+	if err != nil {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	insTitle, err := tx.Prepare(`insert into titles values (?, ?)`)
+	if err != nil {
+		return
+	}
+	insLink, err := tx.Prepare(
+		`insert into linkstats (ngramhash, targetid, count, titlecount,
+		                        aliascount, clickcount)
+		 values (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return
+	}
+
+	var prev string
+	first := true
+	err = mergeLinks(streams, func(e linkEntry) (err error) {
+		if first || e.target != prev {
+			first = false
+			prev = e.target
+			id++
+			if _, err = insTitle.Exec(id, e.target); err != nil {
+				return
+			}
+		}
+		_, err = insLink.Exec(e.hash, id, fromFixed(e.counts[anchorLink]),
+			fromFixed(e.counts[anchorTitle]), fromFixed(e.counts[anchorAlias]),
+			fromFixed(e.counts[anchorClick]))
+		return
+	})
+	if err == nil {
+		err = tx.Commit()
+	}
+	return
+}
+
+// Remove temporary files.
+func (agg *linkAggregator) Close() error {
+	if agg.tmpdir == "" {
+		return nil
+	}
+	return os.RemoveAll(agg.tmpdir)
+}
+
+// Sorted stream of link entries. next returns io.EOF when exhausted.
+type linkStream interface {
+	next() (linkEntry, error)
+}
+
+type sliceStream struct {
+	entries []linkEntry
+}
+
+func (s *sliceStream) next() (e linkEntry, err error) {
+	if len(s.entries) == 0 {
+		err = io.EOF
+		return
+	}
+	e, s.entries = s.entries[0], s.entries[1:]
+	return
+}
+
+// On-disk format of a run: a sequence of records
+//
+//	hash (uint32, little endian)
+//	counts (nAnchorKinds × int64, little endian)
+//	len(target) (uvarint)
+//	target
+const runHeaderSize = 4 + 8*int(nAnchorKinds)
+
+func writeRun(path string, entries []linkEntry) (err error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	w := bufio.NewWriter(f)
+	var buf [runHeaderSize + binary.MaxVarintLen64]byte
+	for _, e := range entries {
+		binary.LittleEndian.PutUint32(buf[:4], e.hash)
+		for i, c := range e.counts {
+			binary.LittleEndian.PutUint64(buf[4+8*i:], uint64(c))
+		}
+		n := binary.PutUvarint(buf[runHeaderSize:], uint64(len(e.target)))
+		if _, err = w.Write(buf[:runHeaderSize+n]); err != nil {
+			return
+		}
+		if _, err = w.WriteString(e.target); err != nil {
+			return
+		}
+	}
+	return w.Flush()
+}
+
+type runReader struct {
+	f *os.File
+	r *bufio.Reader
+}
+
+func openRun(path string) (*runReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &runReader{f, bufio.NewReader(f)}, nil
+}
+
+func (r *runReader) next() (e linkEntry, err error) {
+	var buf [runHeaderSize]byte
+	if _, err = io.ReadFull(r.r, buf[:]); err != nil {
+		return // io.EOF at a record boundary, ErrUnexpectedEOF otherwise.
+	}
+	e.hash = binary.LittleEndian.Uint32(buf[:4])
+	for i := range e.counts {
+		e.counts[i] = int64(binary.LittleEndian.Uint64(buf[4+8*i:]))
+	}
+
+	n, err := binary.ReadUvarint(r.r)
+	if err == nil {
+		target := make([]byte, n)
+		_, err = io.ReadFull(r.r, target)
+		e.target = string(target)
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+func (r *runReader) Close() error {
+	return r.f.Close()
+}
+
+type streamHead struct {
+	cur    linkEntry
+	stream linkStream
+}
+
+type streamHeap []*streamHead
+
+func (h streamHeap) Len() int            { return len(h) }
+func (h streamHeap) Less(i, j int) bool  { return h[i].cur.less(h[j].cur.linkKey) }
+func (h streamHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *streamHeap) Push(x interface{}) { *h = append(*h, x.(*streamHead)) }
+
+func (h *streamHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// Merge sorted streams, summing the counts for equal keys, and call emit on
+// each resulting entry in sorted order.
+func mergeLinks(streams []linkStream, emit func(linkEntry) error) error {
+	h := make(streamHeap, 0, len(streams))
+	for _, s := range streams {
+		e, err := s.next()
+		if err == io.EOF {
+			continue
+		} else if err != nil {
+			return err
+		}
+		h = append(h, &streamHead{e, s})
+	}
+	heap.Init(&h)
+
+	var acc linkEntry
+	have := false
+	for len(h) > 0 {
+		top := h[0]
+		if have && top.cur.linkKey == acc.linkKey {
+			for i, c := range top.cur.counts {
+				acc.counts[i] += c
+			}
+		} else {
+			if have {
+				if err := emit(acc); err != nil {
+					return err
+				}
+			}
+			acc, have = top.cur, true
+		}
+
+		e, err := top.stream.next()
+		if err == io.EOF {
+			heap.Pop(&h)
+			continue
+		} else if err != nil {
+			return err
+		}
+		top.cur = e
+		heap.Fix(&h, 0)
+	}
+	if have {
+		return emit(acc)
+	}
+	return nil
+}
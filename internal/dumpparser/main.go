@@ -3,15 +3,12 @@
 package dumpparser
 
 import (
-	"bufio"
-	"compress/bzip2"
-	"database/sql"
 	"fmt"
 	"io"
 	"log"
-	"os"
-	"path/filepath"
 	"runtime"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -25,25 +22,81 @@ import (
 	"github.com/semanticize/st/wikidump"
 )
 
-func open(path string) (r io.ReadCloser, err error) {
-	rf, err := os.Open(path)
-	if err != nil {
-		return
-	}
-	r = struct {
-		*bufio.Reader
-		io.Closer
-	}{bufio.NewReader(rf), rf}
-	if filepath.Ext(path) == ".bz2" {
-		r = struct {
-			io.Reader
-			io.Closer
-		}{bzip2.NewReader(r), rf}
-	}
-	return
+// Options for building a model.
+type Options struct {
+	NRows, NCols int // Shape of the n-gram count-min sketch.
+	MaxNGram     int // Max. length of n-grams.
+
+	// Pseudo-counts for using article titles and redirect titles as anchors
+	// for the articles they refer to. These are stored separately from the
+	// link counts, in the titlecount column of linkstats. A title's
+	// qualifier, as in "Mercury (planet)", is not part of the anchor.
+	// Zero disables this.
+	TitleCount, RedirectCount float64
+
+	// Pseudo-count for using the alternative names that are set in bold in
+	// the first paragraph of an article as anchors for that article. These
+	// are stored in the aliascount column of linkstats. Zero disables this.
+	AliasCount float64
+
+	// Remove link targets that don't exist as articles (red links) from the
+	// model. If false, they're kept, but have no row in the pages table.
+	DropRedLinks bool
+
+	// Names of templates that mark disambiguation pages. If nil,
+	// wikidump.DefaultDisambigTemplates is used.
+	DisambigTemplates []string
+
+	// Kinds of markup to extract links from, in addition to the running
+	// text. The content of such markup is never used for n-gram counting.
+	LinkMarkup wikidump.Markup
+
+	// Count n-grams in the text rendered by wikidump.PlainText, rather than
+	// in the output of wikidump.Cleanup, which still contains some markup.
+	PlainText bool
+
+	// Store the first paragraph of each article as its abstract, truncated
+	// to this many bytes (see wikidump.Abstract). Zero disables this.
+	AbstractLength int
+
+	// Path to a dump of the page_props table (.sql or .sql.gz), from which
+	// to import Wikidata item ids. Optional.
+	PageProps string
+
+	// Path to a dump of the langlinks table (.sql or .sql.gz), from which to
+	// import interlanguage links. Optional. If Langs is not empty, only links
+	// to those languages are imported.
+	LangLinks string
+	Langs     []string
+
+	// Record the categories of articles, and the parent categories of
+	// categories, from the category links in their wikitext.
+	Categories bool
+
+	// Path to a dump of the categorylinks table (.sql or .sql.gz), from which
+	// to import category membership. Optional.
+	CategoryLinks string
+
+	// Mapping from infobox templates to entity types. If nil,
+	// wikidump.DefaultInfoboxTypes is used.
+	InfoboxTypes *wikidump.InfoboxTypes
+
+	// Paths to pageview or clickstream dumps (plain, .gz or .bz2), from which
+	// to import view counts as a popularity prior. Optional. Counts from all
+	// files are summed. Only pageviews for PageviewsProject (e.g., "en") are
+	// used; if empty, the project is derived from the dump's database name.
+	Pageviews        []string
+	PageviewsProject string
+
+	// Paths to clickstream dumps (plain, .gz or .bz2) for the same wiki as
+	// the dump. Optional. If given, the clicks from each article to another
+	// are divided over the links between them, by anchor, and stored in the
+	// clickcount column of linkstats. This takes an extra pass over the dump
+	// to collect the redirects.
+	Clickstream []string
 }
 
-func Main(dbpath, dumppath, download string, nrows, ncols, maxNGram int,
+func Main(dbpath, dumppath, download string, opts *Options,
 	logger *log.Logger) (err error) {
 
 	defer func() {
@@ -56,11 +109,11 @@ func Main(dbpath, dumppath, download string, nrows, ncols, maxNGram int,
 			}
 		}
 	}()
-	realMain(dbpath, dumppath, download, nrows, ncols, maxNGram, logger)
+	realMain(dbpath, dumppath, download, opts, logger)
 	return
 }
 
-func realMain(dbpath, dumppath, download string, nrows, ncols, maxNGram int,
+func realMain(dbpath, dumppath, download string, opts *Options,
 	logger *log.Logger) {
 
 	var err error
@@ -77,35 +130,78 @@ func realMain(dbpath, dumppath, download string, nrows, ncols, maxNGram int,
 		panic("no --download and no dumppath specified (try --help)")
 	}
 
-	f, err := open(dumppath)
+	siteinfo, err := readSiteInfo(dumppath)
+	if err != nil {
+		logger.Printf("%v; using defaults", err)
+		siteinfo, err = wikidump.DefaultSiteInfo, nil
+	} else {
+		logger.Printf("Dump of %s (%s)", siteinfo.DBName, siteinfo.Base)
+	}
+
+	f, err := wikidump.Open(dumppath)
 	check()
 	defer f.Close()
 
 	logger.Printf("Creating database at %s", dbpath)
 	db, err := storage.MakeDB(dbpath, true,
-		&storage.Settings{Dumpname: dumppath, MaxNGram: uint(maxNGram)})
+		&storage.Settings{Dumpname: dumppath, MaxNGram: uint(opts.MaxNGram),
+			Case: siteinfo.Case})
 	check()
 
 	// The numbers here are completely arbitrary.
 	nworkers := runtime.GOMAXPROCS(0)
 	articles := make(chan *wikidump.Page, 10*nworkers)
-	linkch := make(chan *processedLink, 10*nworkers)
 	redirch := make(chan *wikidump.Redirect, 10*nworkers)
 
 	// Clean up and tokenize articles, extract links, count n-grams.
 	counters := make(chan *countmin.Sketch, nworkers)
-	counterTotal, err := countmin.New(nrows, ncols)
+	// These MUST be buffered.
+	allPages := make(chan []storage.PageInfo, nworkers)
+	allCategories := make(chan []storage.CategoryInfo, nworkers)
+	counterTotal, err := countmin.New(opts.NRows, opts.NCols)
 	check()
 
-	go wikidump.GetPages(f, articles, redirch)
+	links := newLinkAggregator(maxLinksInMemory)
+	defer links.Close()
+
+	var clicks *clickJoiner
+	if len(opts.Clickstream) > 0 {
+		// Clicks are recorded on the targets of redirects, so we need all
+		// redirects to join them with the links in each article.
+		logger.Printf("Collecting redirects for the clickstream")
+		var redirs []wikidump.Redirect
+		redirs, err = readRedirects(dumppath)
+		check()
+		clicks = newClickJoiner(redirs)
+		for _, path := range opts.Clickstream {
+			logger.Printf("Reading clickstream from %s", path)
+			var cs io.ReadCloser
+			cs, err = wikidump.Open(path)
+			check()
+			var n int
+			n, err = clicks.read(cs)
+			cs.Close()
+			check()
+			logger.Printf("Read %d clickstream links", n)
+		}
+	}
+
+	if opts.Categories || opts.CategoryLinks != "" {
+		go wikidump.GetPagesNS(f, articles, redirch, 14)
+	} else {
+		go wikidump.GetPages(f, articles, redirch)
+	}
 
 	logger.Printf("processing dump with %d workers", nworkers)
 	var narticles uint32
 	for i := 0; i < nworkers; i++ {
 		// These signal completion by sending on counters.
 		go func() {
-			counters <- processPages(articles, linkch, &narticles,
-				nrows, ncols, maxNGram)
+			ngramcount, pages, cats := processPages(articles, links,
+				clicks, &narticles, siteinfo, opts)
+			allPages <- pages
+			allCategories <- cats
+			counters <- ngramcount
 		}()
 	}
 
@@ -117,20 +213,17 @@ func realMain(dbpath, dumppath, download string, nrows, ncols, maxNGram int,
 			counterTotal.Sum(<-counters)
 		}
 		close(counters) // Force panic for programmer error.
-		close(linkch)   // We know the workers are done now.
 		wg.Done()
 	}()
 
-	// Collect redirects. We store these in nworkers slices to avoid having
-	// to copy them into a single structure.
+	// Collect redirects into nworkers slices, to be concatenated once all
+	// pages have been processed.
 	// The allRedirects channel MUST be buffered.
 	wg.Add(nworkers)
 	allRedirects := make(chan []wikidump.Redirect, nworkers)
-	var nredirs uint32
 	for i := 0; i < nworkers; i++ {
 		go func() {
 			slice := collectRedirects(redirch)
-			atomic.AddUint32(&nredirs, uint32(len(slice)))
 			allRedirects <- slice
 			wg.Done()
 		}()
@@ -138,20 +231,121 @@ func realMain(dbpath, dumppath, download string, nrows, ncols, maxNGram int,
 
 	go pageProgress(&narticles, logger, &wg)
 
-	err = storeLinks(db, linkch)
-
 	wg.Wait()
 	close(allRedirects)
-	// Check error from storeLinks now, after goroutines have stopped.
-	check()
+	close(allPages)
+	close(allCategories)
 
-	logger.Printf("Processing redirects")
-	bar := pb.StartNew(int(nredirs))
+	var redirects []wikidump.Redirect
 	for slice := range allRedirects {
-		err = storage.StoreRedirects(db, slice, bar)
+		redirects = append(redirects, slice...)
+	}
+	if opts.RedirectCount > 0 {
+		for _, r := range redirects {
+			links.add(processTitle(r.Title, r.Target, opts.RedirectCount,
+				opts.MaxNGram))
+		}
+	}
+
+	logger.Printf("Storing link statistics")
+	err = links.store(db)
+	check()
+
+	var pages []storage.PageInfo
+	for slice := range allPages {
+		pages = append(pages, slice...)
+	}
+	logger.Printf("Storing metadata for %d pages", len(pages))
+	bar := pb.StartNew(len(pages))
+	err = storage.StorePages(db, pages, bar)
+	check()
+	bar.Finish()
+
+	var cats []storage.CategoryInfo
+	for slice := range allCategories {
+		cats = append(cats, slice...)
+	}
+	if len(cats) > 0 {
+		logger.Printf("Storing %d categories", len(cats))
+		err = storage.StoreCategories(db, cats)
 		check()
 	}
+	if opts.CategoryLinks != "" {
+		logger.Printf("Importing categories from %s", opts.CategoryLinks)
+		var cl io.ReadCloser
+		cl, err = wikidump.Open(opts.CategoryLinks)
+		check()
+		var n int64
+		n, err = storage.StoreCategoryLinks(db, cl)
+		cl.Close()
+		check()
+		logger.Printf("Stored %d category memberships", n)
+	}
+
+	if opts.PageProps != "" {
+		logger.Printf("Importing Wikidata ids from %s", opts.PageProps)
+		var pp io.ReadCloser
+		pp, err = wikidump.Open(opts.PageProps)
+		check()
+		var n int64
+		n, err = storage.StoreWikidata(db, pp)
+		pp.Close()
+		check()
+		logger.Printf("Found Wikidata ids for %d pages", n)
+	}
+
+	if opts.LangLinks != "" {
+		logger.Printf("Importing interlanguage links from %s", opts.LangLinks)
+		var ll io.ReadCloser
+		ll, err = wikidump.Open(opts.LangLinks)
+		check()
+		var n int64
+		n, err = storage.StoreLangLinks(db, ll, opts.Langs)
+		ll.Close()
+		check()
+		logger.Printf("Stored %d interlanguage links", n)
+	}
+
+	if len(opts.Pageviews) > 0 {
+		project := opts.PageviewsProject
+		if project == "" {
+			project = projectCode(siteinfo.DBName)
+		}
+		views := make(map[string]int64)
+		for _, path := range opts.Pageviews {
+			logger.Printf("Reading pageviews for %q from %s", project, path)
+			var pv io.ReadCloser
+			pv, err = wikidump.Open(path)
+			check()
+			err = siteinfo.ReadPageviews(pv, project,
+				func(title string, count int64) error {
+					views[title] += count
+					return nil
+				})
+			pv.Close()
+			check()
+		}
+		var n int64
+		n, err = storage.StorePageviews(db, views, redirects)
+		check()
+		logger.Printf("Stored pageviews for %d pages", n)
+	}
+
+	logger.Printf("Processing redirects")
+	bar = pb.StartNew(len(redirects))
+	rstats, err := storage.StoreRedirects(db, redirects, bar)
+	check()
 	bar.Finish()
+	logger.Printf("Resolved %d redirect chains; skipped %d redirects in cycles"+
+		" and %d dangling redirects", rstats.Chains, rstats.Cycles,
+		rstats.Dangling)
+
+	if opts.DropRedLinks {
+		var n int64
+		n, err = storage.DropRedLinks(db)
+		check()
+		logger.Printf("Removed %d red links", n)
+	}
 
 	err = storage.StoreCM(db, counterTotal)
 	check()
@@ -163,6 +357,43 @@ func realMain(dbpath, dumppath, download string, nrows, ncols, maxNGram int,
 	check()
 }
 
+// Project code used in pageview dumps for the wiki with the given database
+// name, e.g., "en" for enwiki and "zh-yue" for zh_yuewiki. Returns the empty
+// string, meaning all projects, for names it doesn't recognize.
+func projectCode(dbname string) string {
+	if !strings.HasSuffix(dbname, "wiki") {
+		return ""
+	}
+	return strings.Replace(strings.TrimSuffix(dbname, "wiki"), "_", "-", -1)
+}
+
+// Read the <siteinfo> at the start of the dump at path.
+func readSiteInfo(path string) (*wikidump.SiteInfo, error) {
+	f, err := wikidump.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return wikidump.ReadSiteInfo(f)
+}
+
+// Read the redirects from the dump at path, skipping the articles.
+func readRedirects(path string) ([]wikidump.Redirect, error) {
+	f, err := wikidump.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pages, redirch := make(chan *wikidump.Page), make(chan *wikidump.Redirect)
+	go wikidump.GetPages(f, pages, redirch)
+	go func() {
+		for _ = range pages {
+		}
+	}()
+	return collectRedirects(redirch), nil
+}
+
 // Collect redirects from redirch into a slice.
 //
 // We have to collect these in memory because we process them only after all
@@ -178,30 +409,96 @@ func collectRedirects(redirch <-chan *wikidump.Redirect) []wikidump.Redirect {
 }
 
 func processPages(articles <-chan *wikidump.Page,
-	linkch chan<- *processedLink, narticles *uint32,
-	nrows, ncols, maxN int) *countmin.Sketch {
+	linkagg *linkAggregator, clicks *clickJoiner, narticles *uint32,
+	siteinfo *wikidump.SiteInfo, opts *Options) (*countmin.Sketch,
+	[]storage.PageInfo, []storage.CategoryInfo) {
+
+	maxN := opts.MaxNGram
+	disambigTemplates := opts.DisambigTemplates
+	if disambigTemplates == nil {
+		disambigTemplates = wikidump.DefaultDisambigTemplates
+	}
+	infoboxTypes := opts.InfoboxTypes
+	if infoboxTypes == nil {
+		infoboxTypes = wikidump.DefaultInfoboxTypes
+	}
 
-	ngramcount, err := countmin.New(nrows, ncols)
+	ngramcount, err := countmin.New(opts.NRows, opts.NCols)
 	if err != nil {
 		// Shouldn't happen; we already constructed a count-min sketch
 		// with the exact same size in main.
 		panic(err)
 	}
 
+	var pages []storage.PageInfo
+	var cats []storage.CategoryInfo
 	for a := range articles {
-		text := wikidump.Cleanup(a.Text)
-		links := wikidump.ExtractLinks(text)
+		if a.Namespace == 14 {
+			name, ok := siteinfo.CategoryName(a.Title)
+			if ok {
+				cat := storage.CategoryInfo{Name: name, PageID: a.ID}
+				if opts.Categories {
+					cat.Parents = siteinfo.Categories(a.Text)
+				}
+				cats = append(cats, cat)
+			}
+			continue
+		}
+
+		info := storage.PageInfo{
+			Title:     a.Title,
+			ID:        a.ID,
+			Length:    len(a.Text),
+			Timestamp: a.Timestamp,
+		}
+		// Templates are removed by Cleanup, so check them first.
+		templates := siteinfo.Templates(a.Text)
+		info.Disambiguation = wikidump.HasTemplate(templates,
+			disambigTemplates)
+		info.Type = infoboxTypes.Type(wikidump.Infoboxes(templates,
+			wikidump.DefaultInfoboxPrefixes))
+		if opts.Categories {
+			info.Categories = siteinfo.Categories(a.Text)
+		}
+		if opts.AbstractLength > 0 {
+			info.Abstract = siteinfo.Abstract(a.Text, opts.AbstractLength)
+		}
+
+		if opts.TitleCount > 0 {
+			linkagg.add(processTitle(a.Title, a.Title, opts.TitleCount, maxN))
+		}
+		if opts.AliasCount > 0 {
+			for _, alias := range siteinfo.LeadAliases(a.Text) {
+				linkagg.add(processAnchor(alias, a.Title, opts.AliasCount,
+					anchorAlias, maxN))
+			}
+		}
+
+		text, linktext := siteinfo.CleanupLinks(a.Text, opts.LinkMarkup)
+		links := siteinfo.ExtractLinks(linktext)
 		for link, freq := range links {
-			linkch <- processLink(&link, freq, maxN)
+			linkagg.add(processLink(&link, freq, maxN))
+			if info.Disambiguation {
+				info.DisambigOptions = append(info.DisambigOptions,
+					link.Target)
+			}
 		}
+		if clicks != nil {
+			clicks.join(a.Title, links, linkagg, maxN)
+		}
+		sort.Strings(info.DisambigOptions)
+		pages = append(pages, info)
 
+		if opts.PlainText {
+			text, _ = siteinfo.PlainText(a.Text)
+		}
 		tokens := nlp.Tokenize(text)
 		for _, h := range hash.NGrams(tokens, 1, maxN) {
 			ngramcount.Add1(h)
 		}
 		atomic.AddUint32(narticles, 1)
 	}
-	return ngramcount
+	return ngramcount, pages, cats
 }
 
 // Regularly report the number of pages processed so far.
@@ -225,66 +522,66 @@ func pageProgress(narticles *uint32, logger *log.Logger, wg *sync.WaitGroup) {
 	}
 }
 
+// Kinds of anchors, each counted separately in linkstats.
+type anchorKind int
+
+const (
+	anchorLink  anchorKind = iota // Anchor text of a wikilink.
+	anchorTitle                   // Article or redirect title.
+	anchorAlias                   // Bold name in an article's lead.
+	anchorClick                   // Anchor of a link, counted by clicks.
+	nAnchorKinds
+)
+
 type processedLink struct {
 	target       string
 	anchorHashes []uint32
 	freq         float64
+	kind         anchorKind
 }
 
-func processLink(link *wikidump.Link, freq, maxN int) *processedLink {
-	tokens := nlp.Tokenize(link.Anchor)
+func anchorHashes(anchor string, maxN int) []uint32 {
+	tokens := nlp.Tokenize(anchor)
 	n := min(maxN, len(tokens))
-	hashes := hash.NGrams(tokens, n, n)
+	return hash.NGrams(tokens, n, n)
+}
+
+func processLink(link *wikidump.Link, freq, maxN int) *processedLink {
+	hashes := anchorHashes(link.Anchor, maxN)
 	count := float64(freq)
 	if len(hashes) > 1 {
 		count = 1 / float64(len(hashes))
 	}
-	return &processedLink{link.Target, hashes, count}
+	return &processedLink{link.Target, hashes, count, anchorLink}
 }
 
-// Collect links and store them in the database.
-func storeLinks(db *sql.DB, links <-chan *processedLink) (err error) {
-	tx, err := db.Begin()
-	if err != nil {
-		return
-	}
-	insTitle, err := tx.Prepare(`insert or ignore into titles values (NULL, ?)`)
-	if err != nil {
-		return
-	}
-	insLink, err := tx.Prepare(
-		`insert or ignore into linkstats values
-		 (?, (select id from titles where title = ?), 0)`)
-	if err != nil {
-		return
-	}
-	update, err := tx.Prepare(
-		`update linkstats set count = count + ?
-		 where ngramhash = ?
-		 and targetid = (select id from titles where title =?)`)
-	if err != nil {
-		return
-	}
+// Process title as an anchor for target, with the given pseudo-count.
+func processTitle(title, target string, count float64,
+	maxN int) *processedLink {
 
-	exec := func(stmt *sql.Stmt, args ...interface{}) {
-		if err == nil {
-			_, err = stmt.Exec(args...)
-		}
+	return processAnchor(stripQualifier(title), target, count, anchorTitle,
+		maxN)
+}
+
+// Process anchor as a pseudo-link of the given kind to target.
+func processAnchor(anchor, target string, count float64, kind anchorKind,
+	maxN int) *processedLink {
+
+	hashes := anchorHashes(anchor, maxN)
+	if len(hashes) > 1 {
+		count /= float64(len(hashes))
 	}
+	return &processedLink{target, hashes, count, kind}
+}
 
-	for link := range links {
-		count := link.freq
-		for _, h := range link.anchorHashes {
-			exec(insTitle, link.target)
-			exec(insLink, h, link.target)
-			exec(update, count, h, link.target)
-		}
-		if err != nil {
-			break
+// Strip a parenthesized qualifier, as in "Mercury (planet)", from a title.
+func stripQualifier(title string) string {
+	if strings.HasSuffix(title, ")") {
+		if i := strings.LastIndex(title, " ("); i > 0 {
+			title = title[:i]
 		}
 	}
-	err = tx.Commit()
-	return
+	return title
 }
 
 func min(a, b int) int {
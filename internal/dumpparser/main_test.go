@@ -1,8 +1,23 @@
 package dumpparser
 
 import (
+	"compress/gzip"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
 
+	"github.com/semanticize/st/hash"
 	"github.com/semanticize/st/internal/storage"
 	"github.com/semanticize/st/wikidump"
 )
@@ -23,17 +38,15 @@ func TestStoreLinks(t *testing.T) {
 		close(links)
 	}()
 
-	processed := make(chan *processedLink)
-	go func() {
-		for linkFreq := range links {
-			for link, freq := range linkFreq {
-				processed <- processLink(&link, freq, 3)
-			}
+	agg := newLinkAggregator(maxLinksInMemory)
+	defer agg.Close()
+	for linkFreq := range links {
+		for link, freq := range linkFreq {
+			agg.add(processLink(&link, freq, 3))
 		}
-		close(processed)
-	}()
+	}
 
-	if err := storeLinks(db, processed); err != nil {
+	if err := agg.store(db); err != nil {
 		t.Error(err)
 	}
 
@@ -47,3 +60,804 @@ func TestStoreLinks(t *testing.T) {
 		t.Errorf("expected count=3.0, got %f\n", count)
 	}
 }
+
+const sampleDump = "../../wikidump/nlwiki-20140927-sample.xml"
+
+type tWriter struct {
+	t *testing.T
+}
+
+func (w tWriter) Write(p []byte) (n int, err error) {
+	w.t.Logf("%s", p)
+	return len(p), nil
+}
+
+func testLogger(t *testing.T) *log.Logger {
+	return log.New(tWriter{t}, "", 0)
+}
+
+// Link statistics as (title, hash) -> count.
+type linkTable map[linkKey]float64
+
+func readLinkTable(t *testing.T, db *sql.DB) linkTable {
+	rows, err := db.Query(`select title, ngramhash, count
+	                       from linkstats join titles on targetid = id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	table := make(linkTable)
+	for rows.Next() {
+		var k linkKey
+		var count float64
+		if err = rows.Scan(&k.target, &k.hash, &count); err != nil {
+			t.Fatal(err)
+		}
+		table[k] = count
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return table
+}
+
+func readTitles(t *testing.T, db *sql.DB) map[string]bool {
+	rows, err := db.Query(`select title from titles`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	titles := make(map[string]bool)
+	for rows.Next() {
+		var title string
+		if err = rows.Scan(&title); err != nil {
+			t.Fatal(err)
+		}
+		titles[title] = true
+	}
+	return titles
+}
+
+// Reference implementation: the original one-statement-per-row storage of
+// link statistics, run single-threaded over the dump.
+func buildReference(t *testing.T, maxN int) *sql.DB {
+	db, err := storage.MakeDB(":memory:", true,
+		&storage.Settings{Dumpname: sampleDump, MaxNGram: uint(maxN)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	siteinfo, err := readSiteInfo(sampleDump)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(sampleDump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	pages, redirch := make(chan *wikidump.Page), make(chan *wikidump.Redirect)
+	go wikidump.GetPages(f, pages, redirch)
+
+	var redirects []wikidump.Redirect
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		for r := range redirch {
+			redirects = append(redirects, *r)
+		}
+		wg.Done()
+	}()
+
+	exec := func(q string, args ...interface{}) {
+		if _, err := db.Exec(q, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var infos []storage.PageInfo
+	for p := range pages {
+		infos = append(infos, storage.PageInfo{Title: p.Title, ID: p.ID,
+			Length: len(p.Text), Timestamp: p.Timestamp})
+		text := wikidump.Cleanup(p.Text)
+		for link, freq := range siteinfo.ExtractLinks(text) {
+			l := processLink(&link, freq, maxN)
+			for _, h := range l.anchorHashes {
+				exec(`insert or ignore into titles values (NULL, ?)`, l.target)
+				exec(`insert or ignore into linkstats (ngramhash, targetid, count)
+				      values (?, (select id from titles where title = ?), 0)`,
+					h, l.target)
+				exec(`update linkstats set count = count + ?
+				      where ngramhash = ?
+				      and targetid = (select id from titles where title =?)`,
+					l.freq, h, l.target)
+			}
+		}
+	}
+	wg.Wait()
+
+	if err = storage.StorePages(db, infos, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = storage.StoreRedirects(db, redirects, nil); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// Build a model from dump with the given options.
+func buildModel(t *testing.T, dump string,
+	opts *Options) (db *sql.DB, path string) {
+
+	dbfile, err := ioutil.TempFile("", "semanticizest-dumpparser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path = dbfile.Name()
+	dbfile.Close()
+
+	err = Main(path, dump, "", opts, testLogger(t))
+	if err != nil {
+		os.Remove(path)
+		t.Fatal(err)
+	}
+	db, _, err = storage.LoadModel(path)
+	if err != nil {
+		os.Remove(path)
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestEndToEnd(t *testing.T) {
+	const maxN = 5
+
+	ref := buildReference(t, maxN)
+	defer ref.Close()
+	refLinks, refTitles := readLinkTable(t, ref), readTitles(t, ref)
+	if len(refLinks) == 0 {
+		t.Fatal("no link statistics in reference model")
+	}
+
+	defer func(orig int) { maxLinksInMemory = orig }(maxLinksInMemory)
+	// The second setting forces many spills to disk.
+	for _, maxLinksInMemory = range []int{1 << 20, 5 * nLinkShards} {
+		db, path := buildModel(t, sampleDump,
+			&Options{NRows: 4, NCols: 32, MaxNGram: maxN})
+		links, titles := readLinkTable(t, db), readTitles(t, db)
+		db.Close()
+		os.Remove(path)
+
+		if len(links) != len(refLinks) {
+			t.Errorf("expected %d rows in linkstats, got %d",
+				len(refLinks), len(links))
+		}
+		for k, refCount := range refLinks {
+			count, ok := links[k]
+			if !ok {
+				t.Errorf("missing link %v", k)
+			} else if math.Abs(count-refCount) > 1e-9 {
+				t.Errorf("expected count %f for %v, got %f", refCount, k, count)
+			}
+		}
+
+		if len(titles) != len(refTitles) {
+			t.Errorf("expected %d titles, got %d", len(refTitles), len(titles))
+		}
+		for title := range refTitles {
+			if !titles[title] {
+				t.Errorf("missing title %q", title)
+			}
+		}
+	}
+}
+
+// Hash of the contents of all tables in db, in a fixed order.
+func contentHash(t *testing.T, db *sql.DB) string {
+	h := sha256.New()
+	for _, q := range []string{
+		`select * from parameters order by key`,
+		`select * from titles order by id`,
+		`select * from linkstats order by targetid, ngramhash`,
+		`select * from ngramfreq order by row, col`,
+	} {
+		rows, err := db.Query(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cols, _ := rows.Columns()
+		values := make([]interface{}, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		for rows.Next() {
+			if err = rows.Scan(ptrs...); err != nil {
+				t.Fatal(err)
+			}
+			fmt.Fprintf(h, "%v\n", values)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func TestDeterministic(t *testing.T) {
+	// Make sure there are multiple workers.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+
+	var hashes [2]string
+	for i := range hashes {
+		db, path := buildModel(t, sampleDump,
+			&Options{NRows: 4, NCols: 32, MaxNGram: 7})
+		hashes[i] = contentHash(t, db)
+		db.Close()
+		os.Remove(path)
+	}
+	if hashes[0] != hashes[1] {
+		t.Errorf("two builds from the same dump differ: %s != %s",
+			hashes[0], hashes[1])
+	}
+}
+
+func TestStripQualifier(t *testing.T) {
+	for _, c := range []struct{ in, out string }{
+		{"Mercury (planet)", "Mercury"},
+		{"Heidelberg (Duitsland)", "Heidelberg"},
+		{"Albert Speer", "Albert Speer"},
+		{"(Untitled)", "(Untitled)"},
+		{"Foo (bar) baz", "Foo (bar) baz"},
+	} {
+		if out := stripQualifier(c.in); out != c.out {
+			t.Errorf("expected %q for %q, got %q", c.out, c.in, out)
+		}
+	}
+}
+
+func TestTitleAnchors(t *testing.T) {
+	const maxN = 7
+
+	ref := buildReference(t, maxN)
+	defer ref.Close()
+	refLinks := readLinkTable(t, ref)
+
+	db, path := buildModel(t, sampleDump, &Options{NRows: 4, NCols: 32,
+		MaxNGram: maxN, TitleCount: 2, RedirectCount: 1})
+	defer os.Remove(path)
+	defer db.Close()
+
+	// Link counts must not be affected.
+	links := readLinkTable(t, db)
+	for k, refCount := range refLinks {
+		if math.Abs(links[k]-refCount) > 1e-9 {
+			t.Errorf("expected count %f for %v, got %f", refCount, k, links[k])
+		}
+	}
+
+	titlecount := func(anchor, target string) (count float64) {
+		h := anchorHashes(anchor, maxN)[0]
+		err := db.QueryRow(`select titlecount from linkstats
+		                    where ngramhash = ? and targetid =
+		                    (select id from titles where title = ?)`,
+			h, target).Scan(&count)
+		if err != nil {
+			t.Errorf("%q -> %q: %v", anchor, target, err)
+		}
+		return
+	}
+
+	if c := titlecount("Albert Speer", "Albert Speer"); c != 2 {
+		t.Errorf("expected titlecount 2 for article title, got %f", c)
+	}
+	// The sample dump has one redirect, Architekt -> Architect.
+	if c := titlecount("Architekt", "Architect"); c != 1 {
+		t.Errorf("expected titlecount 1 for redirect, got %f", c)
+	}
+}
+
+func TestRedLinks(t *testing.T) {
+	opts := &Options{NRows: 4, NCols: 32, MaxNGram: 7}
+	db, path := buildModel(t, sampleDump, opts)
+	defer os.Remove(path)
+	defer db.Close()
+
+	var pageid, length int64
+	var timestamp string
+	err := db.QueryRow(`select pageid, length, timestamp from pages
+	                    where titleid =
+	                    (select id from titles where title = "Albert Speer")`,
+	).Scan(&pageid, &length, &timestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pageid != 1 || length == 0 || timestamp != "2014-09-17T16:54:12Z" {
+		t.Errorf("wrong metadata for Albert Speer: %d, %d, %q",
+			pageid, length, timestamp)
+	}
+
+	var npages, nred int
+	db.QueryRow(`select count(*) from pages`).Scan(&npages)
+	db.QueryRow(`select count(*) from titles
+	             where id not in (select titleid from pages)`).Scan(&nred)
+	if npages != 22 {
+		t.Errorf("expected 22 pages, got %d", npages)
+	}
+	if nred == 0 {
+		t.Fatal("expected red links in sample dump")
+	}
+
+	opts.DropRedLinks = true
+	db2, path2 := buildModel(t, sampleDump, opts)
+	defer os.Remove(path2)
+	defer db2.Close()
+
+	var ntitles, nlinks int
+	db2.QueryRow(`select count(*) from titles`).Scan(&ntitles)
+	db2.QueryRow(`select count(*) from linkstats
+	              where targetid not in (select titleid from pages)`,
+	).Scan(&nlinks)
+	if ntitles != npages {
+		t.Errorf("expected %d titles after dropping red links, got %d",
+			npages, ntitles)
+	}
+	if nlinks != 0 {
+		t.Errorf("%d rows in linkstats refer to red links", nlinks)
+	}
+}
+
+type testPage struct {
+	title, text, redirect string
+	ns                    int
+}
+
+const testSiteInfo = `<siteinfo>
+    <sitename>Wikipedia</sitename>
+    <dbname>testwiki</dbname>
+    <base>http://test.wikipedia.org/wiki/Main_Page</base>
+    <case>first-letter</case>
+    <namespaces>
+      <namespace key="0" case="first-letter" />
+      <namespace key="6" case="first-letter">File</namespace>
+      <namespace key="10" case="first-letter">Template</namespace>
+      <namespace key="14" case="first-letter">Category</namespace>
+    </namespaces>
+  </siteinfo>`
+
+// Write a small dump containing pages to a temporary file.
+func writeDump(t *testing.T, pages []testPage) (path string) {
+	f, err := ioutil.TempFile("", "semanticizest-dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	fmt.Fprintf(f, "<mediawiki>\n  %s\n", testSiteInfo)
+	for i, p := range pages {
+		fmt.Fprintf(f, "  <page>\n    <title>")
+		xml.EscapeText(f, []byte(p.title))
+		fmt.Fprintf(f, "</title>\n    <ns>%d</ns>\n    <id>%d</id>\n",
+			p.ns, i+1)
+		if p.redirect != "" {
+			fmt.Fprintf(f, "    <redirect title=\"")
+			xml.EscapeText(f, []byte(p.redirect))
+			fmt.Fprintf(f, "\" />\n")
+		}
+		fmt.Fprintf(f, "    <revision>\n      <id>%d</id>\n", 1000+i)
+		fmt.Fprintf(f, "      <timestamp>2015-01-01T00:00:00Z</timestamp>\n")
+		fmt.Fprintf(f, "      <text xml:space=\"preserve\">")
+		xml.EscapeText(f, []byte(p.text))
+		fmt.Fprintf(f, "</text>\n    </revision>\n  </page>\n")
+	}
+	fmt.Fprintf(f, "</mediawiki>\n")
+	return f.Name()
+}
+
+func TestDisambiguation(t *testing.T) {
+	dump := writeDump(t, []testPage{
+		{title: "Mercury", text: "'''Mercury''' may refer to:\n" +
+			"* [[Mercury (planet)]]\n* [[Mercury (element)|the element]]\n" +
+			"* [[Quicksilver]]\n{{Disambig}}"},
+		{title: "Mercury (planet)", text: "Closest to the [[Sun]]."},
+		{title: "Mercury (element)", text: "A metal.{{Infobox element}}"},
+		{title: "Quicksilver", redirect: "Mercury (element)"},
+		{title: "Solar system", text: "[[Mercury (planet)|Mercury]] and " +
+			"[[Mercury]]."},
+	})
+	defer os.Remove(dump)
+
+	db, path := buildModel(t, dump,
+		&Options{NRows: 4, NCols: 32, MaxNGram: 3})
+	defer os.Remove(path)
+	defer db.Close()
+
+	rows, err := db.Query(`select t.title from pages p
+	                       join titles t on t.id = p.titleid
+	                       where p.disambiguation`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dabs []string
+	for rows.Next() {
+		var title string
+		rows.Scan(&title)
+		dabs = append(dabs, title)
+	}
+	rows.Close()
+	if len(dabs) != 1 || dabs[0] != "Mercury" {
+		t.Errorf("expected only Mercury as disambiguation page, got %q", dabs)
+	}
+
+	var noptions int
+	err = db.QueryRow(`select count(*) from disambiglinks d
+	                   join titles t on t.id = d.targetid
+	                   where t.title in
+	                   ("Mercury (planet)", "Mercury (element)")`,
+	).Scan(&noptions)
+	if err != nil {
+		t.Fatal(err)
+	} else if noptions != 2 {
+		t.Errorf("expected two disambiguation options, got %d", noptions)
+	}
+}
+
+func TestLinkMarkup(t *testing.T) {
+	dump := writeDump(t, []testPage{
+		{title: "Ada Lovelace", text: "{{Infobox person|birth_place=" +
+			"[[London]]}}'''Ada''' wrote about the [[Analytical Engine]]." +
+			"{{Navbox computing|list=[[Computer]]}}"},
+	})
+	defer os.Remove(dump)
+
+	for _, c := range []struct {
+		markup  wikidump.Markup
+		targets []string
+	}{
+		{0, []string{"Analytical Engine"}},
+		{wikidump.TemplateMarkup, []string{"Analytical Engine", "London"}},
+		{wikidump.NavboxMarkup, []string{"Analytical Engine", "Computer"}},
+		{wikidump.AllMarkup, []string{"Analytical Engine", "Computer",
+			"London"}},
+	} {
+		db, path := buildModel(t, dump, &Options{NRows: 4,
+			NCols: 32, MaxNGram: 3, LinkMarkup: c.markup})
+		titles := readTitles(t, db)
+		db.Close()
+		os.Remove(path)
+
+		for _, target := range c.targets {
+			if !titles[target] {
+				t.Errorf("link to %q not found with markup %d",
+					target, c.markup)
+			}
+		}
+		// titles also contains the page itself.
+		if len(titles) != len(c.targets)+1 {
+			t.Errorf("expected %d link targets with markup %d, got %v",
+				len(c.targets), c.markup, titles)
+		}
+	}
+}
+
+func TestPlainTextNGrams(t *testing.T) {
+	dump := writeDump(t, []testPage{
+		{title: "Ada Lovelace", text: "'''Ada''' wrote [[program]]s." +
+			"<!-- unverified -->"},
+	})
+	defer os.Remove(dump)
+
+	unverified := hash.NGrams([]string{"unverified"}, 1, 1)[0]
+	for _, plain := range []bool{false, true} {
+		db, path := buildModel(t, dump, &Options{NRows: 4,
+			NCols: 1024, MaxNGram: 3, PlainText: plain})
+		sketch, err := storage.LoadCM(db)
+		db.Close()
+		os.Remove(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Comments are only removed by PlainText.
+		count := sketch.Get(unverified)
+		if plain && count != 0 {
+			t.Errorf("comment counted with PlainText: %d", count)
+		} else if !plain && count == 0 {
+			t.Errorf("comment not counted without PlainText")
+		}
+	}
+}
+
+func TestLeadAliases(t *testing.T) {
+	dump := writeDump(t, []testPage{
+		{title: "Netherlands", text: "'''Holland''', officially " +
+			"'''the Netherlands''', is a [[country]]."},
+	})
+	defer os.Remove(dump)
+
+	const maxN = 3
+	db, path := buildModel(t, dump, &Options{NRows: 4, NCols: 32,
+		MaxNGram: maxN, AliasCount: .5})
+	defer os.Remove(path)
+	defer db.Close()
+
+	h := anchorHashes("Holland", maxN)[0]
+	var count, aliascount float64
+	err := db.QueryRow(`select count, aliascount from linkstats
+	                    where ngramhash = ? and targetid =
+	                    (select id from titles where title = "Netherlands")`,
+		h).Scan(&count, &aliascount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 || aliascount != .5 {
+		t.Errorf("expected count 0, aliascount .5, got %f, %f",
+			count, aliascount)
+	}
+}
+
+func TestWikidata(t *testing.T) {
+	dump := writeDump(t, []testPage{
+		{title: "Douglas Adams", text: "Wrote [[The Hitchhiker's Guide]]."},
+	})
+	defer os.Remove(dump)
+
+	dir, err := ioutil.TempDir("", "semanticizest-pageprops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pageProps := filepath.Join(dir, "page_props.sql.gz")
+	f, err := os.Create(pageProps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := gzip.NewWriter(f)
+	fmt.Fprint(w, "INSERT INTO `page_props` VALUES (1,'wikibase_item','Q42',NULL);\n")
+	w.Close()
+	f.Close()
+
+	db, path := buildModel(t, dump, &Options{NRows: 4, NCols: 32,
+		MaxNGram: 3, PageProps: pageProps})
+	defer os.Remove(path)
+	defer db.Close()
+
+	var qid string
+	err = db.QueryRow(`select wikidata from pages where pageid = 1`).Scan(&qid)
+	if err != nil {
+		t.Fatal(err)
+	} else if qid != "Q42" {
+		t.Errorf("expected Q42, got %q", qid)
+	}
+}
+
+func TestCategories(t *testing.T) {
+	dump := writeDump(t, []testPage{
+		{title: "Marie Curie", text: "A [[physicist]].\n" +
+			"[[Category:Physicists]][[Category:Nobel laureates|Curie]]"},
+		{title: "Category:Physicists", ns: 14,
+			text: "[[Category:Scientists]]"},
+		{title: "Physicists", text: "Not a category page."},
+	})
+	defer os.Remove(dump)
+
+	db, path := buildModel(t, dump, &Options{NRows: 4, NCols: 32,
+		MaxNGram: 3, Categories: true})
+	defer os.Remove(path)
+	defer db.Close()
+
+	rows, err := db.Query(`select c.name from pagecategories pc
+	                       join titles t on t.id = pc.titleid
+	                       join categories c on c.id = pc.categoryid
+	                       where t.title = "Marie Curie" order by c.name`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cats []string
+	for rows.Next() {
+		var cat string
+		rows.Scan(&cat)
+		cats = append(cats, cat)
+	}
+	rows.Close()
+	if len(cats) != 2 || cats[0] != "Nobel laureates" ||
+		cats[1] != "Physicists" {
+		t.Errorf("wrong categories for Marie Curie: %q", cats)
+	}
+
+	var parent string
+	var pageid int64
+	err = db.QueryRow(`select p.name, c.pageid from subcategories s
+	                   join categories c on c.id = s.categoryid
+	                   join categories p on p.id = s.parentid
+	                   where c.name = "Physicists"`).Scan(&parent, &pageid)
+	if err != nil {
+		t.Fatal(err)
+	} else if parent != "Scientists" || pageid != 2 {
+		t.Errorf("expected parent Scientists and page id 2, got %q, %d",
+			parent, pageid)
+	}
+
+	var npages int
+	db.QueryRow(`select count(*) from pages`).Scan(&npages)
+	if npages != 2 {
+		t.Errorf("category page stored as article; %d pages", npages)
+	}
+}
+
+func TestInfoboxTypes(t *testing.T) {
+	dump := writeDump(t, []testPage{
+		{title: "Ada Lovelace", text: "{{Infobox person|name=Ada}}Ada."},
+		{title: "London", text: "{{Infobox settlement|name=London}}City."},
+		{title: "Jupiter", text: "{{Infobox planet}}Planet."},
+		{title: "Blue", text: "A colour."},
+	})
+	defer os.Remove(dump)
+
+	types, err := wikidump.ReadInfoboxTypes(strings.NewReader(
+		"Infobox person\tPER\nInfobox settlement\tLOC\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		types    *wikidump.InfoboxTypes
+		expected map[string]string
+	}{
+		{nil, map[string]string{"Ada Lovelace": "PER", "London": "LOC",
+			"Jupiter": "MISC", "Blue": ""}},
+		{types, map[string]string{"Ada Lovelace": "PER", "London": "LOC",
+			"Jupiter": "", "Blue": ""}},
+	} {
+		db, path := buildModel(t, dump, &Options{NRows: 4,
+			NCols: 32, MaxNGram: 3, InfoboxTypes: c.types})
+		for title, expected := range c.expected {
+			var typ sql.NullString
+			err := db.QueryRow(`select p.type from pages p
+			                    join titles t on t.id = p.titleid
+			                    where t.title = ?`, title).Scan(&typ)
+			if err != nil {
+				t.Error(err)
+			} else if typ.String != expected {
+				t.Errorf("expected type %q for %q, got %q",
+					expected, title, typ.String)
+			}
+		}
+		db.Close()
+		os.Remove(path)
+	}
+}
+
+func TestPageviews(t *testing.T) {
+	dump := writeDump(t, []testPage{
+		{title: "Douglas Adams", text: "Wrote [[Mostly Harmless]]."},
+		{title: "Mostly Harmless", text: "A novel by [[Douglas Adams]]."},
+		{title: "DNA", redirect: "Douglas Adams"},
+	})
+	defer os.Remove(dump)
+
+	dir, err := ioutil.TempDir("", "semanticizest-pageviews")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hourly := filepath.Join(dir, "pageviews-20150101-000000")
+	clickstream := filepath.Join(dir, "clickstream-testwiki-2015-01.tsv")
+	// Titles are normalized by the siteinfo's case rule.
+	err = ioutil.WriteFile(hourly, []byte("test Douglas_Adams 10 0\n"+
+		"test.m DNA 5 0\ntest douglas_Adams 2 0\n"+
+		"en Douglas_Adams 1000 0\n"), 0644)
+	if err == nil {
+		err = ioutil.WriteFile(clickstream,
+			[]byte("Douglas_Adams\tMostly_Harmless\tlink\t7\n"), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, path := buildModel(t, dump, &Options{NRows: 4, NCols: 32,
+		MaxNGram: 3, Pageviews: []string{hourly, clickstream}})
+	defer os.Remove(path)
+	defer db.Close()
+
+	for title, expected := range map[string]int64{
+		"Douglas Adams": 17, "Mostly Harmless": 7} {
+
+		var count int64
+		err := db.QueryRow(`select p.pageviews from pages p
+		                    join titles t on t.id = p.titleid
+		                    where t.title = ?`, title).Scan(&count)
+		if err != nil {
+			t.Error(err)
+		} else if count != expected {
+			t.Errorf("expected %d views for %q, got %d", expected, title, count)
+		}
+	}
+}
+
+func TestClickstream(t *testing.T) {
+	dump := writeDump(t, []testPage{
+		{title: "Douglas Adams", text: "Wrote [[Mostly Harmless]], " +
+			"[[Mostly Harmless|the fifth book]] and [[Hitchhiker]]."},
+		{title: "Mostly Harmless", text: "A novel."},
+		{title: "The Hitchhiker's Guide", text: "A series."},
+		{title: "Hitchhiker", redirect: "The Hitchhiker's Guide"},
+	})
+	defer os.Remove(dump)
+
+	dir, err := ioutil.TempDir("", "semanticizest-clickstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	clickstream := filepath.Join(dir, "clickstream-testwiki-2015-01.tsv")
+	err = ioutil.WriteFile(clickstream, []byte(
+		"Douglas_Adams\tMostly_Harmless\tlink\t10\n"+
+			"Douglas_Adams\tThe_Hitchhiker's_Guide\tlink\t6\n"+
+			"other-search\tDouglas_Adams\texternal\t100\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, path := buildModel(t, dump, &Options{NRows: 4, NCols: 32,
+		MaxNGram: 3, Clickstream: []string{clickstream}})
+	defer os.Remove(path)
+	defer db.Close()
+
+	for _, c := range []struct {
+		anchor, target string
+		clicks         float64
+	}{
+		{"Mostly Harmless", "Mostly Harmless", 5},
+		{"the fifth book", "Mostly Harmless", 5},
+		{"Hitchhiker", "The Hitchhiker's Guide", 6},
+	} {
+		h := anchorHashes(c.anchor, 3)
+		var clicks float64
+		err := db.QueryRow(`select l.clickcount from linkstats l
+		                    join titles t on t.id = l.targetid
+		                    where t.title = ? and l.ngramhash = ?`,
+			c.target, h[0]).Scan(&clicks)
+		if err != nil {
+			t.Errorf("%q -> %q: %v", c.anchor, c.target, err)
+		} else if clicks != c.clicks {
+			t.Errorf("expected %g clicks on %q -> %q, got %g",
+				c.clicks, c.anchor, c.target, clicks)
+		}
+	}
+}
+
+func TestAbstracts(t *testing.T) {
+	dump := writeDump(t, []testPage{
+		{title: "Douglas Adams", text: "{{Infobox writer}}\n'''Douglas " +
+			"Adams''' was an English [[author]].\n\n== Life ==\nBorn."},
+	})
+	defer os.Remove(dump)
+
+	for _, c := range []struct {
+		length   int
+		expected sql.NullString
+	}{
+		{0, sql.NullString{}},
+		{100, sql.NullString{String: "Douglas Adams was an English author.",
+			Valid: true}},
+		{20, sql.NullString{String: "Douglas Adams was...", Valid: true}},
+	} {
+		db, path := buildModel(t, dump, &Options{NRows: 4,
+			NCols: 32, MaxNGram: 3, AbstractLength: c.length})
+		var abstract sql.NullString
+		err := db.QueryRow(`select abstract from pages where pageid = 1`).
+			Scan(&abstract)
+		if err != nil {
+			t.Error(err)
+		} else if abstract != c.expected {
+			t.Errorf("expected abstract %v, got %v", c.expected, abstract)
+		}
+		db.Close()
+		os.Remove(path)
+	}
+}
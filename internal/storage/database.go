@@ -8,9 +8,13 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/semanticize/st/hash/countmin"
 	"github.com/semanticize/st/wikidump"
+	"io"
 	"log"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
 const create = `
@@ -20,6 +24,12 @@ const create = `
 
 	drop table if exists linkstats;
 	drop table if exists ngramfreq;
+	drop table if exists pages;
+	drop table if exists disambiglinks;
+	drop table if exists langlinks;
+	drop table if exists categories;
+	drop table if exists pagecategories;
+	drop table if exists subcategories;
 
 	create table parameters (
 		key   text primary key not NULL,
@@ -38,20 +48,128 @@ const create = `
 	);
 
 	create table linkstats (
-		ngramhash integer not NULL,
-		targetid  integer not NULL,
-		count     float   not NULL
+		ngramhash  integer not NULL,
+		targetid   integer not NULL,
+		count      float   not NULL,
+		-- Pseudo-counts from article and redirect titles used as anchors.
+		titlecount float   not NULL default 0,
+		-- Pseudo-counts from alternative names in article leads.
+		aliascount float   not NULL default 0,
+		-- Estimated number of clicks on links with this anchor, from
+		-- clickstream dumps.
+		clickcount float   not NULL default 0
 		-- Can't get the following to work.
 		--foreign key(targetid) references titles(id)
 	);
 
+	-- Articles that exist in the dump. Link targets without a row here are
+	-- red links.
+	create table pages (
+		titleid        integer primary key, -- id in titles
+		pageid         integer not NULL,
+		length         integer not NULL,    -- length of wikitext, in bytes
+		timestamp      text,                -- revision timestamp, RFC 3339
+		disambiguation integer not NULL default 0,
+		wikidata       text,                -- Wikidata item id (QID)
+		type           text,                -- coarse type, e.g., PER or LOC
+		pageviews      integer not NULL default 0,
+		abstract       text                 -- first paragraph, as plain text
+	);
+	create index pageid on pages(pageid);
+
+	-- Links from disambiguation pages: the options they list.
+	create table disambiglinks (
+		titleid  integer not NULL, -- the disambiguation page
+		targetid integer not NULL
+	);
+	create unique index disambig_target on disambiglinks(titleid, targetid);
+
+	-- Titles of the equivalent articles on Wikipedias in other languages.
+	create table langlinks (
+		titleid integer not NULL, -- id in titles
+		lang    text    not NULL, -- language code, e.g., "en"
+		title   text    not NULL
+	);
+	create unique index title_lang on langlinks(titleid, lang);
+
+	-- Categories, named without namespace prefix.
+	create table categories (
+		id     integer primary key,
+		name   text    unique not NULL,
+		pageid integer -- page id of the category page, if in the dump
+	);
+	create index category_pageid on categories(pageid);
+
+	-- Category membership of articles.
+	create table pagecategories (
+		titleid    integer not NULL, -- id in titles
+		categoryid integer not NULL
+	);
+	create unique index title_category on pagecategories(titleid, categoryid);
+
+	-- Category membership of categories.
+	create table subcategories (
+		categoryid integer not NULL,
+		parentid   integer not NULL
+	);
+	create unique index category_parent on subcategories(categoryid, parentid);
+	create index parent on subcategories(parentid);
+
 	create index target on linkstats(targetid);
 	create unique index hash_target on linkstats(ngramhash, targetid);
 `
 
+// Version of the schema in create. Models without a "schemaversion"
+// parameter have version 1, the schema of the original semanticizest.
+const schemaVersion = 2
+
 type Settings struct {
-	Dumpname string // Filename of dump
-	MaxNGram uint   // Max. length of n-grams
+	Dumpname string `json:"dumpname"`       // Filename of dump
+	MaxNGram uint   `json:"maxngram"`       // Max. length of n-grams
+	Case     string `json:"case,omitempty"` // Capitalization rule for titles
+}
+
+// Tables in a model, in order of creation.
+var tables = []string{"parameters", "ngramfreq", "titles", "linkstats",
+	"pages", "disambiglinks", "langlinks", "categories", "pagecategories",
+	"subcategories"}
+
+// Returns the number of rows in each table of the model in db. Finalize
+// stores these, since counting the rows of a large model takes minutes;
+// tables without a stored size are counted.
+func TableSizes(db *sql.DB) (sizes map[string]int64, err error) {
+	sizes = make(map[string]int64, len(tables))
+	for _, t := range tables {
+		var n int64
+		err = db.QueryRow(`select value from parameters where key = ?`,
+			"rows."+t).Scan(&n)
+		if err == sql.ErrNoRows {
+			err = db.QueryRow("select count(*) from " + t).Scan(&n)
+		}
+		if err != nil {
+			return nil, err
+		}
+		sizes[t] = n
+	}
+	return
+}
+
+// Store the number of rows in each table as parameters, for TableSizes.
+func storeTableSizes(db *sql.DB) (err error) {
+	sizes, err := TableSizes(db)
+	if err != nil {
+		return
+	}
+	// Including the rows about to be added.
+	sizes["parameters"] += int64(len(tables))
+	for _, t := range tables {
+		_, err = db.Exec(`insert or replace into parameters values (?, ?)`,
+			"rows."+t, strconv.FormatInt(sizes[t], 10))
+		if err != nil {
+			return
+		}
+	}
+	return
 }
 
 func MakeDB(path string, overwrite bool, s *Settings) (db *sql.DB, err error) {
@@ -80,6 +198,13 @@ func MakeDB(path string, overwrite bool, s *Settings) (db *sql.DB, err error) {
 		_, err = db.Exec(`insert into parameters values ("maxngram", ?)`,
 			strconv.FormatUint(uint64(s.MaxNGram), 10))
 	}
+	if err == nil && s.Case != "" {
+		_, err = db.Exec(`insert into parameters values ("case", ?)`, s.Case)
+	}
+	if err == nil {
+		_, err = db.Exec(`insert into parameters values ("schemaversion", ?)`,
+			strconv.Itoa(schemaVersion))
+	}
 	return
 }
 
@@ -106,10 +231,27 @@ func LoadModel(path string) (db *sql.DB, s *Settings, err error) {
 }
 
 func loadModel(db *sql.DB) (s *Settings, err error) {
-	s = new(Settings)
+	version := 1
+	var versionStr string
+	rows := db.QueryRow(
+		`select value from parameters where key = "schemaversion"`)
+	err = rows.Scan(&versionStr)
+	if err == nil {
+		version, err = strconv.Atoi(versionStr)
+	} else if err == sql.ErrNoRows {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if version != schemaVersion {
+		return nil, fmt.Errorf("model has schema version %d, expected %d; "+
+			"rebuild it with semanticizest-dumpparser", version, schemaVersion)
+	}
 
+	s = new(Settings)
 	var maxNGramStr string
-	rows := db.QueryRow(`select value from parameters where key = "maxngram"`)
+	rows = db.QueryRow(`select value from parameters where key = "maxngram"`)
 	err = rows.Scan(&maxNGramStr)
 	if err == sql.ErrNoRows {
 		log.Printf("no maxngram setting in database, using default=%d",
@@ -128,6 +270,12 @@ func loadModel(db *sql.DB) (s *Settings, err error) {
 		}
 	}
 
+	// Older models don't record the case rule.
+	rows = db.QueryRow(`select value from parameters where key = "case"`)
+	if err = rows.Scan(&s.Case); err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
 	rows = db.QueryRow(`select value from parameters where key = "dumpname"`)
 	if err = rows.Scan(&s.Dumpname); err != nil && err != sql.ErrNoRows {
 		s = nil
@@ -141,28 +289,131 @@ func Finalize(db *sql.DB) (err error) {
 	if err != nil {
 		return
 	}
+	if err = storeTableSizes(db); err != nil {
+		return
+	}
 	_, err = db.Exec("vacuum;")
 	return
 }
 
 type linkCount struct {
-	hash  int64
-	count float64
+	hash                                      int64
+	count, titlecount, aliascount, clickcount float64
+}
+
+// Statistics about the redirects processed by StoreRedirects.
+type RedirectStats struct {
+	Chains   int // Redirects to redirects, resolved to their final target.
+	Cycles   int // Redirects that are in, or lead into, a cycle.
+	Dangling int // Redirects that end in an empty target.
 }
 
+// Resolve redirects transitively. Returns a map from each redirect's title to
+// its final target, which is not itself a redirect. Redirects that cannot be
+// resolved, because they're part of a cycle or end in an empty target, map
+// to the empty string.
+//
+// If there are multiple redirects with the same title, the smallest target
+// wins, so that the result does not depend on the order of redirs.
+func ResolveRedirects(redirs []wikidump.Redirect) (final map[string]string,
+	stats RedirectStats) {
+
+	target := make(map[string]string, len(redirs))
+	for _, r := range redirs {
+		if t, ok := target[r.Title]; !ok || r.Target < t {
+			target[r.Title] = r.Target
+		}
+	}
+
+	final = make(map[string]string, len(target))
+	dangling := make(map[string]bool)
+	var path []string
+	onPath := make(map[string]bool)
+
+	for title := range target {
+		path = path[:0]
+		var result string
+		isDangling := false
+		for cur := title; ; {
+			if f, ok := final[cur]; ok {
+				result, isDangling = f, dangling[cur]
+				break
+			}
+			next, isRedirect := target[cur]
+			if !isRedirect {
+				result = cur
+				break
+			}
+			if next == "" {
+				isDangling = true
+				path = append(path, cur)
+				break
+			}
+			if onPath[cur] {
+				break // Cycle.
+			}
+			onPath[cur] = true
+			path = append(path, cur)
+			cur = next
+		}
+
+		for _, p := range path {
+			final[p] = result
+			if isDangling {
+				dangling[p] = true
+			}
+			delete(onPath, p)
+		}
+	}
+
+	for title, f := range final {
+		switch {
+		case dangling[title]:
+			stats.Dangling++
+		case f == "":
+			stats.Cycles++
+		case f != target[title]:
+			stats.Chains++
+		}
+	}
+	return
+}
+
+// Move link statistics for redirects to their targets.
+//
+// Redirects are resolved transitively, so double redirects (A→B→C) move
+// everything to C. Links to redirects that cannot be resolved, because of
+// cycles or empty targets, are removed. The result does not depend on the
+// order of redirs.
 func StoreRedirects(db *sql.DB, redirs []wikidump.Redirect,
-	bar *pb.ProgressBar) error {
+	bar *pb.ProgressBar) (stats RedirectStats, err error) {
+
+	final, stats := ResolveRedirects(redirs)
+
+	// Process in sorted order, so that counts are summed in the same order
+	// every time.
+	titles := make([]string, 0, len(final))
+	for title := range final {
+		titles = append(titles, title)
+	}
+	sort.Strings(titles)
+	if bar != nil {
+		// Duplicate redirects have been merged.
+		bar.Total = int64(len(titles))
+	}
 
 	counts := make([]linkCount, 0)
 
 	var titleId, old, del, delTitle, insTitle, ins, update *sql.Stmt
+	var updOptions, delOptions *sql.Stmt
 	tx, err := db.Begin()
 	if err == nil {
 		titleId, err = tx.Prepare(`select id from titles where title = ?`)
 	}
 	if err == nil {
 		old, err = tx.Prepare(
-			`select ngramhash, count from linkstats where targetid = ?`)
+			`select ngramhash, count, titlecount, aliascount, clickcount
+			 from linkstats where targetid = ?`)
 	}
 	if err == nil {
 		del, err = tx.Prepare(`delete from linkstats where targetid = ?`)
@@ -176,43 +427,58 @@ func StoreRedirects(db *sql.DB, redirs []wikidump.Redirect,
 	}
 	if err == nil {
 		ins, err = tx.Prepare(
-			`insert or ignore into linkstats values
-			 (?, (select id from titles where title = ?), 0)`)
+			`insert or ignore into linkstats (ngramhash, targetid, count)
+			 values (?, (select id from titles where title = ?), 0)`)
 	}
 	if err == nil {
 		update, err = tx.Prepare(
-			`update linkstats set count = count + ?
+			`update linkstats
+			 set count = count + ?, titlecount = titlecount + ?,
+			     aliascount = aliascount + ?, clickcount = clickcount + ?
 			 where targetid = (select id from titles where title = ?)
 			       and ngramhash = ?`)
 	}
+	if err == nil {
+		updOptions, err = tx.Prepare(
+			`update or ignore disambiglinks
+			 set targetid = (select id from titles where title = ?)
+			 where targetid = ?`)
+	}
+	if err == nil {
+		delOptions, err = tx.Prepare(
+			`delete from disambiglinks where targetid = ?`)
+	}
 	if err != nil {
-		return err
+		return
 	}
 
-	for _, r := range redirs {
+	for _, title := range titles {
 		if bar != nil {
 			bar.Increment()
 		}
+		target := final[title]
 
 		var fromId int
-		err := titleId.QueryRow(r.Title).Scan(&fromId)
+		err = titleId.QueryRow(title).Scan(&fromId)
 		if err == sql.ErrNoRows { // No links to this redirect.
+			err = nil
 			continue
 		} else if err != nil {
-			return err
+			return
 		}
 
-		rows, err := old.Query(fromId)
+		var rows *sql.Rows
+		rows, err = old.Query(fromId)
 		if err != nil {
-			return err
+			return
 		}
 
 		// SQLite won't let us INSERT or UPDATE while doing a SELECT.
 		for counts = counts[:0]; rows.Next(); {
-			var count float64
-			var hash int64
-			rows.Scan(&hash, &count)
-			counts = append(counts, linkCount{hash, count})
+			var c linkCount
+			rows.Scan(&c.hash, &c.count, &c.titlecount, &c.aliascount,
+				&c.clickcount)
+			counts = append(counts, c)
 		}
 		rows.Close()
 		err = rows.Err()
@@ -225,26 +491,480 @@ func StoreRedirects(db *sql.DB, redirs []wikidump.Redirect,
 		}
 
 		if err != nil {
-			return err
+			return
+		}
+
+		// Point disambiguation options at the final target.
+		if target != "" {
+			_, err = insTitle.Exec(target)
+			if err == nil {
+				_, err = updOptions.Exec(target, fromId)
+			}
+		}
+		if err == nil {
+			_, err = delOptions.Exec(fromId)
+		}
+		if err != nil {
+			return
+		}
+		if target == "" {
+			continue
 		}
 
 		for _, c := range counts {
 			if err == nil {
-				_, err = insTitle.Exec(r.Target)
+				_, err = insTitle.Exec(target)
+			}
+			if err == nil {
+				_, err = ins.Exec(c.hash, target)
+			}
+			if err == nil {
+				_, err = update.Exec(c.count, c.titlecount, c.aliascount,
+					c.clickcount, target, c.hash)
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+	err = tx.Commit()
+	return
+}
+
+// Metadata of an existing article.
+type PageInfo struct {
+	Title     string
+	ID        int64 // Page id.
+	Length    int   // Length of wikitext, in bytes.
+	Timestamp time.Time
+
+	Disambiguation  bool
+	DisambigOptions []string // Link targets of a disambiguation page.
+
+	Categories []string // Names of the categories the page is in.
+
+	Type string // Coarse entity type, from the page's infobox.
+
+	Abstract string // First paragraph, as plain text.
+}
+
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+type pagesByTitle []PageInfo
+
+func (p pagesByTitle) Len() int           { return len(p) }
+func (p pagesByTitle) Less(i, j int) bool { return p[i].Title < p[j].Title }
+func (p pagesByTitle) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// Store metadata of existing articles in the pages table, and the options
+// listed on disambiguation pages in the disambiglinks table. Titles that are
+// not yet in the titles table are added, in sorted order.
+//
+// Sorts pages in place.
+func StorePages(db *sql.DB, pages []PageInfo, bar *pb.ProgressBar) error {
+	sort.Sort(pagesByTitle(pages))
+
+	var insTitle, insPage, insOption, insCat, insPageCat *sql.Stmt
+	tx, err := db.Begin()
+	if err == nil {
+		insTitle, err = tx.Prepare(
+			`insert or ignore into titles values (NULL, ?)`)
+	}
+	if err == nil {
+		insPage, err = tx.Prepare(
+			`insert or replace into pages
+			 (titleid, pageid, length, timestamp, disambiguation, type,
+			  abstract)
+			 values ((select id from titles where title = ?),
+			         ?, ?, ?, ?, ?, ?)`)
+	}
+	if err == nil {
+		insOption, err = tx.Prepare(
+			`insert or ignore into disambiglinks values
+			 ((select id from titles where title = ?),
+			  (select id from titles where title = ?))`)
+	}
+	if err == nil {
+		insCat, err = tx.Prepare(
+			`insert or ignore into categories (name) values (?)`)
+	}
+	if err == nil {
+		insPageCat, err = tx.Prepare(
+			`insert or ignore into pagecategories values
+			 ((select id from titles where title = ?),
+			  (select id from categories where name = ?))`)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, p := range pages {
+		if bar != nil {
+			bar.Increment()
+		}
+		var ts interface{}
+		if !p.Timestamp.IsZero() {
+			ts = p.Timestamp.UTC().Format(time.RFC3339)
+		}
+		_, err = insTitle.Exec(p.Title)
+		if err == nil {
+			_, err = insPage.Exec(p.Title, p.ID, p.Length, ts,
+				p.Disambiguation, nullIfEmpty(p.Type),
+				nullIfEmpty(p.Abstract))
+		}
+		for _, option := range p.DisambigOptions {
+			if err == nil {
+				_, err = insTitle.Exec(option)
+			}
+			if err == nil {
+				_, err = insOption.Exec(p.Title, option)
+			}
+		}
+		for _, cat := range p.Categories {
+			if err == nil {
+				_, err = insCat.Exec(cat)
+			}
+			if err == nil {
+				_, err = insPageCat.Exec(p.Title, cat)
 			}
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// A category page.
+type CategoryInfo struct {
+	Name    string // Without namespace prefix.
+	PageID  int64
+	Parents []string // Names of the categories this category is in.
+}
+
+type categoriesByName []CategoryInfo
+
+func (c categoriesByName) Len() int           { return len(c) }
+func (c categoriesByName) Less(i, j int) bool { return c[i].Name < c[j].Name }
+func (c categoriesByName) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// Store category pages and their parent categories in the categories and
+// subcategories tables.
+//
+// Sorts cats in place.
+func StoreCategories(db *sql.DB, cats []CategoryInfo) (err error) {
+	sort.Sort(categoriesByName(cats))
+
+	var insCat, setPageID, insParent *sql.Stmt
+	tx, err := db.Begin()
+	if err == nil {
+		insCat, err = tx.Prepare(
+			`insert or ignore into categories (name) values (?)`)
+	}
+	if err == nil {
+		setPageID, err = tx.Prepare(
+			`update categories set pageid = ? where name = ?`)
+	}
+	if err == nil {
+		insParent, err = tx.Prepare(
+			`insert or ignore into subcategories values
+			 ((select id from categories where name = ?),
+			  (select id from categories where name = ?))`)
+	}
+	if err != nil {
+		return
+	}
+
+	for _, c := range cats {
+		_, err = insCat.Exec(c.Name)
+		if err == nil {
+			_, err = setPageID.Exec(c.PageID, c.Name)
+		}
+		for _, parent := range c.Parents {
 			if err == nil {
-				_, err = ins.Exec(c.hash, r.Target)
+				_, err = insCat.Exec(parent)
 			}
 			if err == nil {
-				_, err = update.Exec(c.count, r.Target, c.hash)
+				_, err = insParent.Exec(c.Name, parent)
 			}
 		}
 		if err != nil {
+			tx.Rollback()
+			return
+		}
+	}
+	return tx.Commit()
+}
+
+// Store category membership, read from a dump of the categorylinks table
+// (e.g., enwiki-latest-categorylinks.sql), in the pagecategories and
+// subcategories tables. Returns the number of memberships stored.
+//
+// Only memberships of pages and categories whose pages are in the model are
+// stored, so this must be called after StorePages and StoreCategories.
+func StoreCategoryLinks(db *sql.DB, categorylinks io.Reader) (n int64,
+	err error) {
+
+	var insCat, insPageCat, insParent *sql.Stmt
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	insCat, err = tx.Prepare(
+		`insert or ignore into categories (name) values (?)`)
+	if err == nil {
+		insPageCat, err = tx.Prepare(
+			`insert or ignore into pagecategories
+			 select titleid, (select id from categories where name = ?)
+			 from pages where pageid = ?`)
+	}
+	if err == nil {
+		insParent, err = tx.Prepare(
+			`insert or ignore into subcategories
+			 select id, (select id from categories where name = ?)
+			 from categories where pageid = ?`)
+	}
+	if err != nil {
+		return
+	}
+
+	err = wikidump.ReadSQLInserts(categorylinks, "categorylinks",
+		func(row []string) error {
+			// Columns are cl_from, cl_to, cl_sortkey, cl_timestamp,
+			// cl_sortkey_prefix, cl_collation, cl_type.
+			if len(row) < 2 {
+				return nil
+			}
+			pageid, err := strconv.ParseInt(row[0], 10, 64)
+			if err != nil {
+				return err
+			}
+			cat := strings.Replace(row[1], "_", " ", -1)
+
+			ins := insPageCat
+			if len(row) >= 7 && row[6] == "subcat" {
+				ins = insParent
+			} else if len(row) >= 7 && row[6] != "page" {
+				return nil // File.
+			}
+			if _, err = insCat.Exec(cat); err != nil {
+				return err
+			}
+			res, err := ins.Exec(cat, pageid)
+			if err == nil {
+				var m int64
+				m, err = res.RowsAffected()
+				n += m
+			}
 			return err
+		})
+	if err == nil {
+		err = tx.Commit()
+	}
+	return
+}
+
+// Store the Wikidata item ids (QIDs) of pages, read from a dump of the
+// page_props table (e.g., enwiki-latest-page_props.sql), in the pages table.
+// Returns the number of pages that got a QID.
+//
+// Must be called after StorePages.
+func StoreWikidata(db *sql.DB, pageProps io.Reader) (n int64, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
 		}
+	}()
+	update, err := tx.Prepare(`update pages set wikidata = ? where pageid = ?`)
+	if err != nil {
+		return
+	}
+
+	err = wikidump.ReadSQLInserts(pageProps, "page_props",
+		func(row []string) error {
+			// Columns are pp_page, pp_propname, pp_value, pp_sortkey.
+			if len(row) < 3 || row[1] != "wikibase_item" {
+				return nil
+			}
+			pageid, err := strconv.ParseInt(row[0], 10, 64)
+			if err != nil {
+				return err
+			}
+			res, err := update.Exec(row[2], pageid)
+			if err == nil {
+				var m int64
+				m, err = res.RowsAffected()
+				n += m
+			}
+			return err
+		})
+	if err == nil {
+		err = tx.Commit()
+	}
+	return
+}
+
+// Add view counts to the pages table. views maps titles to counts, as read
+// from pageview dumps by wikidump.ReadPageviews. Counts for redirects are
+// added to the pages they redirect to; counts for titles that are not pages
+// are ignored. Returns the number of pages whose count was updated.
+//
+// Must be called after StorePages.
+func StorePageviews(db *sql.DB, views map[string]int64,
+	redirs []wikidump.Redirect) (n int64, err error) {
+
+	final, _ := ResolveRedirects(redirs)
+	total := make(map[string]int64, len(views))
+	for title, count := range views {
+		if target, ok := final[title]; ok {
+			if target == "" {
+				continue // Dangling redirect or cycle.
+			}
+			title = target
+		}
+		total[title] += count
+	}
+
+	// Update in sorted order, for reproducibility.
+	titles := make([]string, 0, len(total))
+	for title := range total {
+		titles = append(titles, title)
+	}
+	sort.Strings(titles)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	update, err := tx.Prepare(
+		`update pages set pageviews = pageviews + ?
+		 where titleid = (select id from titles where title = ?)`)
+	if err != nil {
+		return
+	}
+
+	for _, title := range titles {
+		var res sql.Result
+		res, err = update.Exec(total[title], title)
+		if err != nil {
+			return
+		}
+		var m int64
+		if m, err = res.RowsAffected(); err != nil {
+			return
+		}
+		n += m
 	}
 	err = tx.Commit()
-	return err
+	return
+}
+
+// Store interlanguage links, read from a dump of the langlinks table (e.g.,
+// nlwiki-latest-langlinks.sql), in the langlinks table. If langs is not
+// empty, only links to those languages are stored. Returns the number of
+// links stored.
+//
+// Must be called after StorePages.
+func StoreLangLinks(db *sql.DB, langlinks io.Reader,
+	langs []string) (n int64, err error) {
+
+	keep := make(map[string]bool, len(langs))
+	for _, lang := range langs {
+		keep[lang] = true
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	ins, err := tx.Prepare(
+		`insert or ignore into langlinks
+		 select titleid, ?, ? from pages where pageid = ?`)
+	if err != nil {
+		return
+	}
+
+	err = wikidump.ReadSQLInserts(langlinks, "langlinks",
+		func(row []string) error {
+			// Columns are ll_from, ll_lang, ll_title.
+			if len(row) < 3 || row[2] == "" {
+				return nil
+			}
+			if len(keep) > 0 && !keep[row[1]] {
+				return nil
+			}
+			pageid, err := strconv.ParseInt(row[0], 10, 64)
+			if err != nil {
+				return err
+			}
+			res, err := ins.Exec(row[1], row[2], pageid)
+			if err == nil {
+				var m int64
+				m, err = res.RowsAffected()
+				n += m
+			}
+			return err
+		})
+	if err == nil {
+		err = tx.Commit()
+	}
+	return
+}
+
+// Remove titles that do not exist as pages (red links), with their link
+// statistics. Returns the number of titles removed.
+//
+// Must be called after StorePages and StoreRedirects.
+func DropRedLinks(db *sql.DB) (n int64, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	_, err = tx.Exec(`delete from linkstats
+	                  where targetid not in (select titleid from pages)`)
+	if err == nil {
+		_, err = tx.Exec(`delete from disambiglinks
+		                  where targetid not in (select titleid from pages)`)
+	}
+	if err == nil {
+		var res sql.Result
+		res, err = tx.Exec(
+			`delete from titles where id not in (select titleid from pages)`)
+		if err == nil {
+			n, err = res.RowsAffected()
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	return
 }
 
 // Load count-min sketch from table ngramfreq.
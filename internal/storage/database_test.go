@@ -5,11 +5,14 @@ import (
 	"github.com/semanticize/st/hash/countmin"
 	"github.com/semanticize/st/wikidump"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 )
 
 func TestMakeDB(t *testing.T) {
-	db, err := MakeDB("/", true, &Settings{"blawiki-latest", 2})
+	db, err := MakeDB("/", true,
+		&Settings{Dumpname: "blawiki-latest", MaxNGram: 2})
 	if db != nil {
 		t.Error("got non-nil for invalid path name")
 	}
@@ -27,7 +30,8 @@ func TestLoadModel(t *testing.T) {
 		}
 	}
 
-	db, err := MakeDB(":memory:", true, &Settings{"foowiki", 6})
+	db, err := MakeDB(":memory:", true,
+		&Settings{Dumpname: "foowiki", MaxNGram: 6, Case: "case-sensitive"})
 	check()
 	defer db.Close()
 
@@ -39,6 +43,51 @@ func TestLoadModel(t *testing.T) {
 	if s.MaxNGram != 6 {
 		t.Errorf("expected 6, got %d for maxNGram", s.MaxNGram)
 	}
+	if s.Case != "case-sensitive" {
+		t.Errorf("expected case-sensitive, got %q for case", s.Case)
+	}
+
+	sizes, err := TableSizes(db)
+	check()
+	if len(sizes) != len(tables) {
+		t.Errorf("expected sizes of %d tables, got %v", len(tables), sizes)
+	}
+	if sizes["parameters"] == 0 || sizes["titles"] != 0 {
+		t.Errorf("wrong table sizes %v", sizes)
+	}
+}
+
+// Models built before the schema was versioned can't be loaded.
+func TestLoadOldModel(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// The schema of the original semanticizest.
+	_, err = db.Exec(`
+		create table parameters (key text primary key not NULL,
+		                         value text default NULL);
+		create table ngramfreq (row integer not NULL, col integer not NULL,
+		                        count integer not NULL);
+		create table titles (id integer primary key,
+		                     title text unique not NULL);
+		create table linkstats (ngramhash integer not NULL,
+		                        targetid integer not NULL,
+		                        count float not NULL);
+		insert into parameters values ("dumpname", "foowiki"),
+		                              ("maxngram", "7");`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := loadModel(db)
+	if err == nil || !strings.Contains(err.Error(), "rebuild") {
+		t.Errorf("expected error asking to rebuild the model, got %v", err)
+	}
+	if s != nil {
+		t.Errorf("got settings %+v for old model", s)
+	}
 }
 
 func TestRedirects(t *testing.T) {
@@ -49,13 +98,15 @@ func TestRedirects(t *testing.T) {
 		}
 	}
 
-	db, err := MakeDB(":memory:", true, &Settings{"somewiki", 5})
+	db, err := MakeDB(":memory:", true,
+		&Settings{Dumpname: "somewiki", MaxNGram: 5})
 	check()
 
 	_, err = db.Exec(`insert or ignore into titles values (NULL, "Architekt")`)
 	check()
-	_, err = db.Exec(`insert into linkstats values
-		(42, (select id from titles where title = "Architekt"), 10)`)
+	_, err = db.Exec(`insert into linkstats (ngramhash, targetid, count,
+		                                     clickcount)
+		values (42, (select id from titles where title = "Architekt"), 10, 3)`)
 	check()
 
 	redirects := []wikidump.Redirect{
@@ -63,12 +114,30 @@ func TestRedirects(t *testing.T) {
 		{Title: "Non existent", Target: "Non-existent"},
 	}
 
-	err = StoreRedirects(db, redirects, nil)
+	_, err = StoreRedirects(db, redirects, nil)
 	check()
 	err = Finalize(db)
 	check()
 
-	rows, err := db.Query(`select * from linkstats`)
+	// Finalize stores the table sizes.
+	sizes, err := TableSizes(db)
+	check()
+	for _, table := range []string{"parameters", "titles", "linkstats"} {
+		var stored string
+		var n int64
+		err = db.QueryRow(`select value from parameters where key = ?`,
+			"rows."+table).Scan(&stored)
+		check()
+		err = db.QueryRow(`select count(*) from ` + table).Scan(&n)
+		check()
+		if stored != strconv.FormatInt(n, 10) || sizes[table] != n {
+			t.Errorf("%s: %d rows, stored %q, TableSizes gives %d",
+				table, n, stored, sizes[table])
+		}
+	}
+
+	rows, err := db.Query(
+		`select ngramhash, targetid, count, clickcount from linkstats`)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -76,17 +145,20 @@ func TestRedirects(t *testing.T) {
 		t.Fatal("no rows in database")
 	}
 
-	var count float64
+	var count, clickcount float64
 	var hash int64
 	var toId int64
 	var title string
-	err = rows.Scan(&hash, &toId, &count)
+	err = rows.Scan(&hash, &toId, &count, &clickcount)
 	if hash != 42 {
 		t.Fatalf("wrong hash: %d", hash)
 	}
 	if count != 10 {
 		t.Fatalf("wrong count: %f", count)
 	}
+	if clickcount != 3 {
+		t.Fatalf("wrong clickcount: %f", clickcount)
+	}
 	if rows.Next() {
 		t.Fatal("too many rows (original not deleted?)")
 	}
@@ -113,6 +185,342 @@ func TestRedirects(t *testing.T) {
 	}
 }
 
+func TestResolveRedirects(t *testing.T) {
+	redirects := []wikidump.Redirect{
+		{Title: "A", Target: "B"},
+		{Title: "B", Target: "C"},
+		{Title: "D", Target: "E"},
+		{Title: "E", Target: "D"},
+		{Title: "F", Target: "D"},
+		{Title: "G", Target: "G"},
+		{Title: "H", Target: ""},
+		{Title: "I", Target: "H"},
+		{Title: "J", Target: "K"},
+	}
+	final, stats := ResolveRedirects(redirects)
+
+	expected := map[string]string{
+		"A": "C", "B": "C", "D": "", "E": "", "F": "", "G": "", "H": "",
+		"I": "", "J": "K",
+	}
+	if !reflect.DeepEqual(final, expected) {
+		t.Errorf("expected %v, got %v", expected, final)
+	}
+	expStats := RedirectStats{Chains: 1, Cycles: 4, Dangling: 2}
+	if stats != expStats {
+		t.Errorf("expected %+v, got %+v", expStats, stats)
+	}
+}
+
+func TestRedirectChains(t *testing.T) {
+	redirects := []wikidump.Redirect{
+		{Title: "Double", Target: "Single"},
+		{Title: "Single", Target: "Target"},
+		{Title: "Loop", Target: "Loop 2"},
+		{Title: "Loop 2", Target: "Loop"},
+	}
+
+	// Link statistics by title, after applying the redirects in the given
+	// order.
+	apply := func(redirs []wikidump.Redirect) map[string]float64 {
+		db, err := MakeDB(":memory:", true,
+			&Settings{Dumpname: "somewiki", MaxNGram: 5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		for i, title := range []string{"Double", "Single", "Target", "Loop"} {
+			_, err = db.Exec(`insert into titles values (NULL, ?)`, title)
+			if err == nil {
+				_, err = db.Exec(`insert into linkstats
+				    (ngramhash, targetid, count)
+				    values (42, (select id from titles where title = ?), ?)`,
+					title, i+1)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		stats, err := StoreRedirects(db, redirs, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Chains != 1 || stats.Cycles != 2 {
+			t.Errorf("wrong statistics %+v", stats)
+		}
+
+		rows, err := db.Query(`select title, count
+		                       from linkstats join titles on targetid = id`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		counts := make(map[string]float64)
+		for rows.Next() {
+			var title string
+			var count float64
+			rows.Scan(&title, &count)
+			counts[title] = count
+		}
+		return counts
+	}
+
+	expected := map[string]float64{"Target": 1 + 2 + 3}
+	if got := apply(redirects); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	reversed := make([]wikidump.Redirect, len(redirects))
+	for i, r := range redirects {
+		reversed[len(redirects)-1-i] = r
+	}
+	if got := apply(reversed); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v for reversed redirects, got %v", expected, got)
+	}
+}
+
+func TestDisambiguationPages(t *testing.T) {
+	var err error
+	check := func() {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := MakeDB(":memory:", true,
+		&Settings{Dumpname: "somewiki", MaxNGram: 5})
+	check()
+	defer db.Close()
+
+	err = StorePages(db, []PageInfo{
+		{Title: "Mercury", ID: 1, Disambiguation: true,
+			DisambigOptions: []string{"Mercury (planet)", "Quicksilver"}},
+		{Title: "Mercury (planet)", ID: 2},
+		{Title: "Mercury (element)", ID: 3},
+	}, nil)
+	check()
+	_, err = StoreRedirects(db, []wikidump.Redirect{
+		{Title: "Quicksilver", Target: "Mercury (element)"},
+	}, nil)
+	check()
+
+	rows, err := db.Query(`select t.title from disambiglinks d
+	                       join titles t on t.id = d.targetid
+	                       where d.titleid =
+	                       (select id from titles where title = "Mercury")
+	                       order by t.title`)
+	check()
+	var options []string
+	for rows.Next() {
+		var title string
+		rows.Scan(&title)
+		options = append(options, title)
+	}
+	rows.Close()
+
+	expected := []string{"Mercury (element)", "Mercury (planet)"}
+	if !reflect.DeepEqual(options, expected) {
+		t.Errorf("expected options %q, got %q", expected, options)
+	}
+
+	var disambig bool
+	err = db.QueryRow(`select disambiguation from pages where pageid = 1`).
+		Scan(&disambig)
+	check()
+	if !disambig {
+		t.Error("disambiguation page not marked")
+	}
+}
+
+func TestWikidata(t *testing.T) {
+	var err error
+	check := func() {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := MakeDB(":memory:", true,
+		&Settings{Dumpname: "somewiki", MaxNGram: 5})
+	check()
+	defer db.Close()
+
+	err = StorePages(db, []PageInfo{
+		{Title: "Douglas Adams", ID: 8091},
+		{Title: "New York City", ID: 645042},
+	}, nil)
+	check()
+
+	const pageProps = "INSERT INTO `page_props` VALUES " +
+		"(8091,'wikibase_item','Q42',NULL),(8091,'page_image','DA.jpg',NULL)," +
+		"(12,'wikibase_item','Q5',NULL);\n"
+	n, err := StoreWikidata(db, strings.NewReader(pageProps))
+	check()
+	if n != 1 {
+		t.Errorf("expected QID for one page, got %d", n)
+	}
+
+	var qid sql.NullString
+	err = db.QueryRow(`select wikidata from pages where pageid = 8091`).
+		Scan(&qid)
+	check()
+	if qid.String != "Q42" {
+		t.Errorf("expected Q42, got %q", qid.String)
+	}
+	err = db.QueryRow(`select wikidata from pages where pageid = 645042`).
+		Scan(&qid)
+	check()
+	if qid.Valid {
+		t.Errorf("expected no QID, got %q", qid.String)
+	}
+}
+
+func TestPageviews(t *testing.T) {
+	var err error
+	check := func() {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := MakeDB(":memory:", true,
+		&Settings{Dumpname: "enwiki", MaxNGram: 5})
+	check()
+	defer db.Close()
+
+	err = StorePages(db, []PageInfo{{Title: "Douglas Adams", ID: 8091},
+		{Title: "Mostly Harmless", ID: 19544}}, nil)
+	check()
+
+	views := map[string]int64{
+		"Douglas Adams":  100,
+		"Douglas adams":  5, // Redirect.
+		"Adams, Douglas": 2, // Dangling redirect.
+		"Nonexistent":    1,
+	}
+	redirs := []wikidump.Redirect{
+		{Title: "Douglas adams", Target: "Douglas Adams"},
+		{Title: "Adams, Douglas", Target: ""},
+	}
+	n, err := StorePageviews(db, views, redirs)
+	check()
+	if n != 1 {
+		t.Errorf("expected views for one page, got %d", n)
+	}
+
+	for title, expected := range map[string]int64{
+		"Douglas Adams": 105, "Mostly Harmless": 0} {
+
+		var count int64
+		err = db.QueryRow(`select p.pageviews from pages p
+		                   join titles t on t.id = p.titleid
+		                   where t.title = ?`, title).Scan(&count)
+		check()
+		if count != expected {
+			t.Errorf("expected %d views for %q, got %d", expected, title, count)
+		}
+	}
+}
+
+func TestLangLinks(t *testing.T) {
+	var err error
+	check := func() {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := MakeDB(":memory:", true,
+		&Settings{Dumpname: "nlwiki", MaxNGram: 5})
+	check()
+	defer db.Close()
+
+	err = StorePages(db, []PageInfo{{Title: "Nederland", ID: 3},
+		{Title: "Amsterdam", ID: 5}}, nil)
+	check()
+
+	const langlinks = "INSERT INTO `langlinks` VALUES (3,'en','Netherlands')," +
+		"(3,'fy','Nederlân'),(5,'en','Amsterdam'),(7,'en','Unknown page');\n"
+	n, err := StoreLangLinks(db, strings.NewReader(langlinks), []string{"en"})
+	check()
+	if n != 2 {
+		t.Errorf("expected 2 interlanguage links, got %d", n)
+	}
+
+	var title string
+	err = db.QueryRow(`select l.title from langlinks l
+	                   join titles t on t.id = l.titleid
+	                   where t.title = "Nederland" and l.lang = "en"`,
+	).Scan(&title)
+	check()
+	if title != "Netherlands" {
+		t.Errorf("expected Netherlands, got %q", title)
+	}
+}
+
+func TestCategories(t *testing.T) {
+	var err error
+	check := func() {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := MakeDB(":memory:", true,
+		&Settings{Dumpname: "somewiki", MaxNGram: 5})
+	check()
+	defer db.Close()
+
+	err = StorePages(db, []PageInfo{
+		{Title: "Marie Curie", ID: 1, Categories: []string{"Physicists"}},
+		{Title: "Paris", ID: 2},
+	}, nil)
+	check()
+	err = StoreCategories(db, []CategoryInfo{
+		{Name: "Physicists", PageID: 10, Parents: []string{"Scientists"}},
+		{Name: "Scientists", PageID: 11, Parents: []string{"People"}},
+		{Name: "Cities", PageID: 12},
+	})
+	check()
+
+	const categorylinks = "INSERT INTO `categorylinks` VALUES " +
+		"(2,'Cities','PARIS','2014-01-01 00:00:00','','uppercase','page')," +
+		"(12,'Places','CITIES','2014-01-01 00:00:00','','uppercase','subcat')," +
+		"(99,'Cities','X','2014-01-01 00:00:00','','uppercase','page');\n"
+	n, err := StoreCategoryLinks(db, strings.NewReader(categorylinks))
+	check()
+	if n != 2 {
+		t.Errorf("expected 2 category links, got %d", n)
+	}
+
+	rows, err := db.Query(`select t.title, c.name
+	                       from pagecategories pc
+	                       join titles t on t.id = pc.titleid
+	                       join categories c on c.id = pc.categoryid
+	                       order by t.title`)
+	check()
+	var members []string
+	for rows.Next() {
+		var title, cat string
+		rows.Scan(&title, &cat)
+		members = append(members, title+" in "+cat)
+	}
+	rows.Close()
+	expected := []string{"Marie Curie in Physicists", "Paris in Cities"}
+	if !reflect.DeepEqual(members, expected) {
+		t.Errorf("expected %q, got %q", expected, members)
+	}
+
+	var nsub int
+	err = db.QueryRow(`select count(*) from subcategories`).Scan(&nsub)
+	check()
+	if nsub != 3 {
+		t.Errorf("expected 3 subcategory links, got %d", nsub)
+	}
+}
+
 func TestCM(t *testing.T) {
 	var err error
 	check := func() {
@@ -122,7 +530,8 @@ func TestCM(t *testing.T) {
 	}
 
 	cm, _ := countmin.New(5, 16)
-	db, err := MakeDB(":memory:", true, &Settings{"foowiki.xml.bz2", 8})
+	db, err := MakeDB(":memory:", true,
+		&Settings{Dumpname: "foowiki.xml.bz2", MaxNGram: 8})
 	check()
 
 	for _, i := range []uint32{1, 6, 13, 7, 8, 20, 44} {
@@ -3,6 +3,9 @@ package linking
 
 import (
 	"database/sql"
+	"errors"
+	"strings"
+	"sync/atomic"
 
 	"github.com/semanticize/st/hash"
 	"github.com/semanticize/st/hash/countmin"
@@ -11,10 +14,232 @@ import (
 )
 
 type Semanticizer struct {
-	db         *sql.DB
-	ngramcount *countmin.Sketch
-	maxNGram   uint
-	allQuery   *sql.Stmt
+	db            *sql.DB
+	ngramcount    *countmin.Sketch
+	maxNGram      uint
+	allQuery      *sql.Stmt
+	disambigQuery *sql.Stmt
+	langQuery     *sql.Stmt
+	lookupQuery   *sql.Stmt
+	stats         *queryStats
+	closed        *int32           // Set by Close. Shared with copies.
+	tableSizes    map[string]int64 // Counted at load time.
+	opts          Options
+
+	// Ids of the categories in the subtrees selected by opts.Categories,
+	// or the error from looking them up. Computed by WithOptions.
+	catFilter map[int64]bool
+	catErr    error
+}
+
+// Returned by a Semanticizer, and the copies of it made by WithOptions, after
+// it has been closed.
+var ErrClosed = errors.New("linking: model has been closed")
+
+// Options for candidate generation. The zero value gives the default
+// behavior.
+type Options struct {
+	// Count article titles and redirects used as anchors (pseudo-counts,
+	// see dumpparser.Options) as links when computing LinkCount,
+	// Commonness and Senseprob.
+	TitleAnchors bool
+
+	// Likewise, count alternative names from article leads used as anchors.
+	Aliases bool
+
+	// Leave out candidates that are disambiguation pages. Their links still
+	// count towards LinkCount and Commonness of the other candidates.
+	ExcludeDisambiguation bool
+
+	// Add the options listed on disambiguation pages as extra candidates,
+	// with the disambiguation page in Via and zero Commonness and Senseprob.
+	ExpandDisambiguation bool
+
+	// Language code of a Wikipedia (e.g., "en") to map targets to, using the
+	// interlanguage links in the model. Candidates whose target has no
+	// equivalent in Lang keep their target, but have an empty Lang field,
+	// unless DropUntranslated is set, in which case they are left out.
+	Lang             string
+	DropUntranslated bool
+
+	// Only return candidates that are in one of these categories, or in one
+	// of their subcategories up to CategoryDepth levels down.
+	Categories    []string
+	CategoryDepth int
+
+	// Fill in the Categories field of candidates.
+	ShowCategories bool
+
+	// Fill in the Description field of candidates.
+	Descriptions bool
+}
+
+// Returns the options used by sem.
+func (sem Semanticizer) Options() Options {
+	return sem.opts
+}
+
+// Returns a copy of sem that uses the given options. The copy shares the
+// underlying model with sem.
+//
+// If opts.Categories is set, this looks up the category subtrees. An error
+// in doing so is returned by the copy's All and ExactMatch.
+func (sem Semanticizer) WithOptions(opts Options) Semanticizer {
+	sem.opts = opts
+	sem.catFilter, sem.catErr = nil, nil
+	if len(opts.Categories) > 0 {
+		sem.catFilter, sem.catErr = sem.categorySubtree(opts.Categories,
+			opts.CategoryDepth)
+	}
+	return sem
+}
+
+// Returns the ids of the named categories and their subcategories, up to
+// depth levels down.
+func (sem Semanticizer) categorySubtree(names []string,
+	depth int) (map[int64]bool, error) {
+
+	ids := make(map[int64]bool)
+	var frontier []int64
+	for _, name := range names {
+		var id int64
+		name = strings.Replace(name, "_", " ", -1)
+		err := sem.timed(queryCategoryTree, func() error {
+			return sem.db.QueryRow(
+				`select id from categories where name = ?`, name).Scan(&id)
+		})
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if !ids[id] {
+			ids[id] = true
+			frontier = append(frontier, id)
+		}
+	}
+
+	// Breadth-first, since the category graph has cycles.
+	for ; depth > 0 && len(frontier) > 0; depth-- {
+		var next []int64
+		for _, parent := range frontier {
+			err := sem.timed(queryCategoryTree, func() error {
+				rows, err := sem.db.Query(`select categoryid
+				                           from subcategories
+				                           where parentid = ?`, parent)
+				if err != nil {
+					return err
+				}
+				defer rows.Close()
+				for rows.Next() {
+					var id int64
+					rows.Scan(&id)
+					if !ids[id] {
+						ids[id] = true
+						next = append(next, id)
+					}
+				}
+				return rows.Err()
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		frontier = next
+	}
+	return ids, nil
+}
+
+// Returns the names of the categories that the article target is in, in
+// sorted order.
+func (sem Semanticizer) Categories(target string) (cats []string, err error) {
+	defer func() { err = sem.checkClosed(err) }()
+	byTarget, err := sem.categories([]string{target})
+	for _, c := range byTarget[target] {
+		cats = append(cats, c.name)
+	}
+	return
+}
+
+type category struct {
+	id   int64
+	name string
+}
+
+// SQLite allows at most 999 parameters per statement.
+const maxCategoryTargets = 500
+
+// Returns the categories of each of the articles targets, sorted by name.
+func (sem Semanticizer) categories(targets []string) (map[string][]category,
+	error) {
+
+	cats := make(map[string][]category)
+	for len(targets) > 0 {
+		batch := targets
+		if len(batch) > maxCategoryTargets {
+			batch = batch[:maxCategoryTargets]
+		}
+		targets = targets[len(batch):]
+
+		args := make([]interface{}, len(batch))
+		for i, t := range batch {
+			args[i] = t
+		}
+		err := sem.timed(queryCategories, func() error {
+			rows, err := sem.db.Query(
+				`select t.title, c.id, c.name from pagecategories pc
+				 join titles t on t.id = pc.titleid
+				 join categories c on c.id = pc.categoryid
+				 where t.title in (?`+strings.Repeat(", ?", len(batch)-1)+`)
+				 order by c.name`, args...)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var target string
+				var c category
+				if err = rows.Scan(&target, &c.id, &c.name); err != nil {
+					return err
+				}
+				cats[target] = append(cats[target], c)
+			}
+			return rows.Err()
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cats, nil
+}
+
+// Leave out the candidates that are not in sem.catFilter, if it's set, and
+// fill in the categories of the rest if sem.opts.ShowCategories is set.
+func (sem Semanticizer) filterCategories(cands []Entity) ([]Entity, error) {
+	targets := make([]string, len(cands))
+	for i, c := range cands {
+		targets[i] = c.Target
+	}
+	cats, err := sem.categories(targets)
+	if err != nil {
+		return cands, err
+	}
+
+	i := 0
+	for _, c := range cands {
+		keep := sem.catFilter == nil
+		for _, cat := range cats[c.Target] {
+			keep = keep || sem.catFilter[cat.id]
+			if sem.opts.ShowCategories {
+				c.Categories = append(c.Categories, cat.name)
+			}
+		}
+		if keep {
+			cands[i] = c
+			i++
+		}
+	}
+	return cands[:i], nil
 }
 
 // Load a semanticizer (entity linker) from modelpath.
@@ -39,21 +264,139 @@ func Load(modelpath string) (sem *Semanticizer,
 	if err != nil {
 		return
 	}
+	sem, err = newSemanticizer(db, ngramcount, settings.MaxNGram)
+	return
+}
+
+func newSemanticizer(db *sql.DB, ngramcount *countmin.Sketch,
+	maxNGram uint) (sem *Semanticizer, err error) {
+
 	allq, err := prepareAllQuery(db)
 	if err != nil {
 		return
 	}
+	disambigq, err := db.Prepare(
+		`select t.title, p.pageid, p.wikidata, p.type, p.pageviews,
+		        p.abstract
+		 from disambiglinks d join titles t on t.id = d.targetid
+		      left join pages p on p.titleid = d.targetid
+		 where d.titleid = ? order by t.title`)
+	if err != nil {
+		return
+	}
+	langq, err := db.Prepare(
+		`select l.title from langlinks l join titles t on t.id = l.titleid
+		 where t.title = ? and l.lang = ?`)
+	if err != nil {
+		return
+	}
+
+	lookupq, err := db.Prepare(
+		`select t.title, p.pageid, p.wikidata, p.type, p.pageviews,
+		        p.abstract, p.disambiguation
+		 from titles t left join pages p on p.titleid = t.id
+		 where t.title = ?`)
+	if err != nil {
+		return
+	}
+	// Cheap for finalized models, which store their table sizes.
+	sizes, err := storage.TableSizes(db)
+	if err != nil {
+		return
+	}
 
-	sem = &Semanticizer{db: db, ngramcount: ngramcount,
-		maxNGram: settings.MaxNGram, allQuery: allq}
+	sem = &Semanticizer{db: db, ngramcount: ngramcount, maxNGram: maxNGram,
+		allQuery: allq, disambigQuery: disambigq, langQuery: langq,
+		lookupQuery: lookupq, stats: new(queryStats), closed: new(int32),
+		tableSizes: sizes}
 	return
 }
 
+// Close the model. sem and all copies of it made by WithOptions become
+// unusable: their methods that query the model return ErrClosed.
+func (sem *Semanticizer) Close() error {
+	if sem.closed != nil {
+		atomic.StoreInt32(sem.closed, 1)
+	}
+	return sem.db.Close()
+}
+
+// Returns ErrClosed instead of err if sem has been closed. database/sql
+// doesn't export its error for a closed database.
+func (sem Semanticizer) checkClosed(err error) error {
+	if err != nil && sem.closed != nil && atomic.LoadInt32(sem.closed) != 0 {
+		return ErrClosed
+	}
+	return err
+}
+
+// Reports an error if sem's database cannot be queried.
+func (sem Semanticizer) Ping() error {
+	var n int64
+	return sem.checkClosed(
+		sem.db.QueryRow(`select count(*) from parameters`).Scan(&n))
+}
+
+// Returns the number of rows in each table of the model, as counted when it
+// was loaded.
+func (sem Semanticizer) TableSizes() map[string]int64 {
+	sizes := make(map[string]int64, len(sem.tableSizes))
+	for t, n := range sem.tableSizes {
+		sizes[t] = n
+	}
+	return sizes
+}
+
+// Returns the dimensions of the count-min sketch of n-gram counts.
+func (sem Semanticizer) SketchSize() (rows, cols int) {
+	return sem.ngramcount.NRows(), sem.ngramcount.NCols()
+}
+
 // Represents a mention of an entity.
 type Entity struct {
 	// Title of target Wikipedia article.
 	Target string `json:"target"`
 
+	// Page id of Target. Zero if Target doesn't exist (a red link).
+	PageID int64 `json:"pageid,omitempty"`
+
+	// Whether Target exists as an article in the Wikipedia dump.
+	Exists bool `json:"exists"`
+
+	// Wikidata item id (QID) of Target, if known.
+	Wikidata string `json:"wikidata,omitempty"`
+
+	// Coarse type of Target (e.g., PER, LOC, ORG or MISC), derived from its
+	// infobox, if it has one.
+	Type string `json:"type,omitempty"`
+
+	// Whether Target is a disambiguation page.
+	Disambiguation bool `json:"disambiguation,omitempty"`
+
+	// Number of views of Target in the pageview or clickstream dumps that
+	// the model was built with, including views of redirects to it. A prior
+	// on how popular Target is, independent of the anchor; zero if unknown.
+	Pageviews int64 `json:"pageviews,omitempty"`
+
+	// If Options.Lang is set: the language of Target, if an equivalent was
+	// found, and the title of the article in the model's language that it's
+	// equivalent to. PageID, Exists, Wikidata and Disambiguation refer to
+	// that article.
+	Lang   string `json:"lang,omitempty"`
+	Source string `json:"source,omitempty"`
+
+	// Categories of Target, if Options.ShowCategories is set.
+	Categories []string `json:"categories,omitempty"`
+
+	// First paragraph of Target, as plain text, if Options.Descriptions is
+	// set and the model was built with abstracts. Always in the model's
+	// language, even if Lang is set.
+	Description string `json:"description,omitempty"`
+
+	// Disambiguation page that lists Target, if this candidate was found
+	// through one (see Options.ExpandDisambiguation).
+	Via string `json:"via,omitempty"`
+
 	// Raw n-gram count estimate.
 	NGramCount float64 `json:"ngramcount"`
 
@@ -63,6 +406,14 @@ type Entity struct {
 	Commonness float64 `json:"commonness"`
 	Senseprob  float64 `json:"senseprob"`
 
+	// Estimated number of times readers followed a link with this anchor
+	// to Target, from clickstream dumps. ClickThrough is its share of the
+	// clicks on links with this anchor: like Commonness, but reflecting
+	// what readers choose rather than what editors link to. Both are zero
+	// if the model has no clickstream data for the anchor.
+	ClickCount   float64 `json:"clickcount,omitempty"`
+	ClickThrough float64 `json:"clickthrough,omitempty"`
+
 	// Offset of anchor in input string.
 	Offset int `json:"offset"`
 
@@ -72,51 +423,233 @@ type Entity struct {
 
 func prepareAllQuery(db *sql.DB) (*sql.Stmt, error) {
 	return db.Prepare(
-		`select (select title from titles where id = targetid), count
-		 from linkstats where ngramhash = ?`)
+		`select t.title, l.targetid, l.count, l.titlecount, l.aliascount,
+		        l.clickcount, p.pageid, p.disambiguation, p.wikidata, p.type,
+		        p.pageviews, p.abstract
+		 from linkstats l join titles t on t.id = l.targetid
+		      left join pages p on p.titleid = l.targetid
+		 where l.ngramhash = ?`)
 }
 
-// Get candidates for hash value h from the database. offset and end index
-// into the original string and are stored on the return values.
-func (sem Semanticizer) candidates(h uint32, offset, end int) (cands []Entity, err error) {
-	rows, err := sem.allQuery.Query(h)
+func (sem Semanticizer) description(abstract sql.NullString) string {
+	if !sem.opts.Descriptions {
+		return ""
+	}
+	return abstract.String
+}
+
+// Returns what the model knows about the article with the given title:
+// everything in Entity except the fields that describe a mention. The
+// Description and Categories are always filled in, regardless of sem's
+// options. Returns nil if title does not occur in the model, neither as an
+// article nor as a link target.
+func (sem Semanticizer) Lookup(title string) (e *Entity, err error) {
+	defer func() { err = sem.checkClosed(err) }()
+	var pageid, pageviews sql.NullInt64
+	var wikidata, typ, abstract sql.NullString
+	var disambig sql.NullBool
+	e = new(Entity)
+	err = sem.timed(queryLookup, func() error {
+		return sem.lookupQuery.QueryRow(title).Scan(&e.Target, &pageid,
+			&wikidata, &typ, &pageviews, &abstract, &disambig)
+	})
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	e.PageID, e.Exists = pageid.Int64, pageid.Valid
+	e.Wikidata, e.Type = wikidata.String, typ.String
+	e.Pageviews, e.Description = pageviews.Int64, abstract.String
+	e.Disambiguation = disambig.Bool
+	e.Categories, err = sem.Categories(e.Target)
 	if err != nil {
-		return
+		return nil, err
 	}
+	return
+}
 
-	var count, totalLinkCount float64
+// Get candidates for hash value h from the database. offset and end index
+// into the original string and are stored on the return values.
+func (sem Semanticizer) candidates(h uint32, offset, end int) (cands []Entity, err error) {
+	var count, titlecount, aliascount, totalLinkCount float64
+	var clickcount, totalClickCount float64
 	var target string
-	for rows.Next() {
-		rows.Scan(&target, &count)
-		totalLinkCount += count
-		// Initially use the Commonness field to store the number of links
-		// to the target with the given hash.
-		cands = append(cands, Entity{
-			Target:     target,
-			Commonness: count,
-			Senseprob:  0,
-			Offset:     offset,
-			Length:     end - offset,
-		})
-	}
-	rows.Close()
-	err = rows.Err()
+	var targetid int64
+	var pageid, pageviews sql.NullInt64
+	var disambig sql.NullBool
+	var wikidata, typ, abstract sql.NullString
+	var disambigIds []int64 // Title ids of disambiguation candidates.
+	err = sem.timed(queryCandidates, func() error {
+		rows, err := sem.allQuery.Query(h)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			rows.Scan(&target, &targetid, &count, &titlecount, &aliascount,
+				&clickcount, &pageid, &disambig, &wikidata, &typ, &pageviews,
+				&abstract)
+			if sem.opts.TitleAnchors {
+				count += titlecount
+			}
+			if sem.opts.Aliases {
+				count += aliascount
+			}
+			if count == 0 {
+				continue
+			}
+			totalLinkCount += count
+			totalClickCount += clickcount
+			if disambig.Bool {
+				disambigIds = append(disambigIds, targetid)
+			}
+			// Initially use the Commonness field to store the number of
+			// links to the target with the given hash.
+			cands = append(cands, Entity{
+				Target:         target,
+				PageID:         pageid.Int64,
+				Exists:         pageid.Valid,
+				Wikidata:       wikidata.String,
+				Type:           typ.String,
+				Disambiguation: disambig.Bool,
+				Pageviews:      pageviews.Int64,
+				Description:    sem.description(abstract),
+				Commonness:     count,
+				Senseprob:      0,
+				ClickCount:     clickcount,
+				Offset:         offset,
+				Length:         end - offset,
+			})
+		}
+		return rows.Err()
+	})
 	if err != nil {
 		return
 	}
 
+	ngramcount := float64(sem.ngramcount.Get(h))
 	for i := range cands {
 		c := &cands[i]
-		c.NGramCount = float64(sem.ngramcount.Get(h))
+		c.NGramCount = ngramcount
 		c.Senseprob = c.Commonness / c.NGramCount
 		c.Commonness /= totalLinkCount
 		c.LinkCount = totalLinkCount
+		if totalClickCount > 0 {
+			c.ClickThrough = c.ClickCount / totalClickCount
+		}
+	}
+
+	if sem.opts.ExpandDisambiguation && len(disambigIds) > 0 {
+		cands, err = sem.expandDisambiguation(cands, disambigIds)
+	}
+	if sem.opts.ExcludeDisambiguation {
+		i := 0
+		for _, c := range cands {
+			if !c.Disambiguation {
+				cands[i] = c
+				i++
+			}
+		}
+		cands = cands[:i]
+	}
+	if err == nil && len(cands) > 0 &&
+		(len(sem.opts.Categories) > 0 || sem.opts.ShowCategories) {
+		cands, err = sem.filterCategories(cands)
+	}
+	if err == nil && sem.opts.Lang != "" {
+		cands, err = sem.translate(cands)
 	}
 	return
 }
 
+// Map the targets of cands to their equivalents in sem.opts.Lang.
+func (sem Semanticizer) translate(cands []Entity) ([]Entity, error) {
+	i := 0
+	for _, c := range cands {
+		var title string
+		err := sem.timed(queryLang, func() error {
+			return sem.langQuery.QueryRow(c.Target, sem.opts.Lang).Scan(&title)
+		})
+		switch {
+		case err == sql.ErrNoRows:
+			if sem.opts.DropUntranslated {
+				continue
+			}
+		case err != nil:
+			return cands, err
+		default:
+			c.Source, c.Target, c.Lang = c.Target, title, sem.opts.Lang
+		}
+		cands[i] = c
+		i++
+	}
+	return cands[:i], nil
+}
+
+// Add the options listed on the disambiguation pages with the given title
+// ids to cands, which must be the candidates for a single anchor.
+func (sem Semanticizer) expandDisambiguation(cands []Entity,
+	disambigIds []int64) ([]Entity, error) {
+
+	seen := make(map[string]bool, len(cands))
+	var dabs []Entity
+	for _, c := range cands {
+		seen[c.Target] = true
+		if c.Disambiguation {
+			dabs = append(dabs, c)
+		}
+	}
+
+	for i, id := range disambigIds {
+		dab := dabs[i]
+		err := sem.timed(queryDisambig, func() error {
+			rows, err := sem.disambigQuery.Query(id)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var option string
+				var pageid, pageviews sql.NullInt64
+				var wikidata, typ, abstract sql.NullString
+				rows.Scan(&option, &pageid, &wikidata, &typ, &pageviews,
+					&abstract)
+				if seen[option] {
+					continue
+				}
+				seen[option] = true
+				cands = append(cands, Entity{
+					Target:      option,
+					PageID:      pageid.Int64,
+					Exists:      pageid.Valid,
+					Wikidata:    wikidata.String,
+					Type:        typ.String,
+					Pageviews:   pageviews.Int64,
+					Description: sem.description(abstract),
+					Via:         dab.Target,
+					NGramCount:  dab.NGramCount,
+					LinkCount:   dab.LinkCount,
+					Offset:      dab.Offset,
+					Length:      dab.Length,
+				})
+			}
+			return rows.Err()
+		})
+		if err != nil {
+			return cands, err
+		}
+	}
+	return cands, nil
+}
+
 // Get all candidate entity mentions in the string s.
 func (sem Semanticizer) All(s string) (cands []Entity, err error) {
+	defer func() { err = sem.checkClosed(err) }()
+	if sem.catErr != nil {
+		return nil, sem.catErr
+	}
 	tokens, tokpos := nlp.TokenizePos(s)
 	return sem.allFromTokens(tokens, tokpos)
 }
@@ -125,7 +658,14 @@ func (sem Semanticizer) All(s string) (cands []Entity, err error) {
 //
 // A candidate entity's anchor text must be exactly s.
 func (sem Semanticizer) ExactMatch(s string) (cands []Entity, err error) {
+	defer func() { err = sem.checkClosed(err) }()
+	if sem.catErr != nil {
+		return nil, sem.catErr
+	}
 	tokens := nlp.Tokenize(s)
+	if len(tokens) == 0 {
+		return nil, nil
+	}
 	h := hash.NGrams(tokens, len(tokens), len(tokens))[0]
 	return sem.candidates(h, 0, len(tokens))
 }
@@ -138,7 +678,8 @@ func (sem Semanticizer) allFromTokens(tokens []string,
 		start, end := hpos.Start, hpos.End-1
 		start, end = tokpos[start][0], tokpos[end][1]
 
-		add, err := sem.candidates(hpos.Hash, start, end)
+		var add []Entity
+		add, err = sem.candidates(hpos.Hash, start, end)
 		if err != nil {
 			break
 		}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"reflect"
+	"sort"
 	"testing"
 
 	"github.com/semanticize/st/hash"
@@ -23,7 +24,8 @@ func makeSemanticizer() Semanticizer {
 	sem := Semanticizer{db: db, ngramcount: cm, maxNGram: 2, allQuery: allq}
 
 	for _, h := range hash.NGrams([]string{"Hello", "world"}, 2, 2) {
-		_, err := db.Exec(`insert into linkstats values (?, 0, 1)`, h)
+		_, err := db.Exec(`insert into linkstats (ngramhash, targetid, count)
+		                      values (?, 0, 1)`, h)
 		if err == nil {
 			_, err = db.Exec(`insert into titles values (0, "dmr")`)
 		}
@@ -49,6 +51,141 @@ func TestCandidates(t *testing.T) {
 	}
 }
 
+func TestTitleAnchors(t *testing.T) {
+	cm, _ := countmin.New(10, 4)
+	db, _ := storage.MakeDB(":memory:", true, &storage.Settings{MaxNGram: 2})
+	defer db.Close()
+	sem, err := newSemanticizer(db, cm, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := hash.NGrams([]string{"Hello"}, 1, 1)[0]
+	_, err = db.Exec(`insert into titles values
+	                  (1, "Hello"), (2, "Hi"), (3, "Howdy")`)
+	if err == nil {
+		_, err = db.Exec(`insert into linkstats
+		                  (ngramhash, targetid, count, titlecount, aliascount)
+		                  values (?, 1, 3, 0, 0), (?, 2, 0, 1, 0),
+		                         (?, 3, 0, 0, 2)`, h, h, h)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := sem.All("Hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 || all[0].Commonness != 1 {
+		t.Errorf("expected only %q with commonness 1, got %v", "Hello", all)
+	}
+
+	all, err = sem.WithOptions(Options{TitleAnchors: true}).All("Hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 {
+		t.Fatalf("expected two candidates, got %v", all)
+	}
+	for _, e := range all {
+		if e.LinkCount != 4 {
+			t.Errorf("expected LinkCount 4, got %f", e.LinkCount)
+		}
+	}
+
+	all, err = sem.WithOptions(Options{Aliases: true}).All("Hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 {
+		t.Fatalf("expected two candidates, got %v", all)
+	}
+	for _, e := range all {
+		if e.Target == "Howdy" && e.Commonness != .4 {
+			t.Errorf("expected commonness .4 for alias, got %f",
+				e.Commonness)
+		}
+	}
+}
+
+func TestDisambiguation(t *testing.T) {
+	cm, _ := countmin.New(10, 4)
+	db, _ := storage.MakeDB(":memory:", true, &storage.Settings{MaxNGram: 2})
+	defer db.Close()
+	sem, err := newSemanticizer(db, cm, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := hash.NGrams([]string{"Mercury"}, 1, 1)[0]
+	for _, q := range []string{
+		`insert into titles values (1, "Mercury"), (2, "Mercury (planet)"),
+		                           (3, "Mercury (element)"), (4, "Freddie")`,
+		`insert into pages (titleid, pageid, length, timestamp,
+		                    disambiguation, wikidata, type, pageviews)
+		 values (1, 10, 100, NULL, 1, "Q216294", NULL, 3),
+		        (2, 20, 100, NULL, 0, "Q308", "LOC", 1200),
+		        (3, 30, 100, NULL, 0, "Q925", "MISC", 800)`,
+		`insert into disambiglinks values (1, 2), (1, 3)`,
+	} {
+		if _, err = db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = db.Exec(`insert into linkstats (ngramhash, targetid, count,
+	                                         clickcount)
+	                  values (?, 1, 2, 0), (?, 2, 6, 30), (?, 4, 2, 10)`,
+		h, h, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	targets := func(opts Options) map[string]Entity {
+		all, err := sem.WithOptions(opts).All("Mercury")
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := make(map[string]Entity)
+		for _, e := range all {
+			m[e.Target] = e
+		}
+		return m
+	}
+
+	all := targets(Options{})
+	if len(all) != 3 {
+		t.Errorf("expected three candidates, got %v", all)
+	}
+	if !all["Mercury"].Disambiguation || all["Mercury (planet)"].Disambiguation {
+		t.Errorf("disambiguation page not flagged correctly: %v", all)
+	}
+	if e := all["Mercury (planet)"]; e.ClickCount != 30 || e.ClickThrough != .75 {
+		t.Errorf("expected 30 clicks, click-through .75, got %v", e)
+	}
+
+	all = targets(Options{ExcludeDisambiguation: true})
+	if _, ok := all["Mercury"]; ok || len(all) != 2 {
+		t.Errorf("expected disambiguation page to be excluded, got %v", all)
+	}
+	if c := all["Mercury (planet)"].Commonness; c != .6 {
+		t.Errorf("expected commonness .6, got %f", c)
+	}
+
+	all = targets(Options{ExpandDisambiguation: true})
+	if len(all) != 4 {
+		t.Errorf("expected four candidates, got %v", all)
+	}
+	if e := all["Mercury (element)"]; e.Via != "Mercury" || !e.Exists ||
+		e.Wikidata != "Q925" || e.Type != "MISC" || e.Pageviews != 800 {
+		t.Errorf("wrong candidate from disambiguation page: %v", e)
+	}
+	if e := all["Mercury (planet)"]; e.Via != "" || e.Commonness != .6 ||
+		e.Wikidata != "Q308" || e.Type != "LOC" || e.Pageviews != 1200 {
+		t.Errorf("direct candidate replaced by option: %v", e)
+	}
+}
+
 func BenchmarkCandidates(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		_, err := sem.All("Let's try and see if we can semanticize a sentence.")
@@ -67,17 +204,262 @@ func TestExactMatch(t *testing.T) {
 		t.Errorf("expected one entity mention, got %v", all)
 	}
 
-	all, err = sem.ExactMatch("Hello world program")
+	for _, s := range []string{"Hello world program", "", " ?! "} {
+		all, err = sem.ExactMatch(s)
+		if err != nil {
+			t.Error(err)
+		}
+		if len(all) != 0 {
+			t.Errorf("expected no entity mentions in %q, got %v", s, all)
+		}
+	}
+}
+
+func TestLang(t *testing.T) {
+	cm, _ := countmin.New(10, 4)
+	db, _ := storage.MakeDB(":memory:", true, &storage.Settings{MaxNGram: 2})
+	defer db.Close()
+	sem, err := newSemanticizer(db, cm, 2)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+
+	h := hash.NGrams([]string{"Holland"}, 1, 1)[0]
+	for _, q := range []string{
+		`insert into titles values (1, "Nederland"), (2, "Holland (regio)")`,
+		`insert into langlinks values (1, "en", "Netherlands"),
+		                              (1, "de", "Niederlande")`,
+	} {
+		if _, err = db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = db.Exec(`insert into linkstats (ngramhash, targetid, count)
+	                  values (?, 1, 3), (?, 2, 1)`, h, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := sem.WithOptions(Options{Lang: "en"}).All("Holland")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 {
+		t.Fatalf("expected two candidates, got %v", all)
+	}
+	for _, e := range all {
+		switch e.Source {
+		case "Nederland":
+			if e.Target != "Netherlands" || e.Lang != "en" {
+				t.Errorf("wrong translation %v", e)
+			}
+		case "":
+			if e.Target != "Holland (regio)" || e.Lang != "" {
+				t.Errorf("untranslated candidate changed: %v", e)
+			}
+		}
+	}
+
+	all, err = sem.WithOptions(Options{Lang: "en", DropUntranslated: true}).
+		All("Holland")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 || all[0].Target != "Netherlands" {
+		t.Errorf("expected only Netherlands, got %v", all)
+	}
+
+	// Copies made by WithOptions share the statistics.
+	stats := sem.QueryStats()
+	if n := stats["candidates"].Count; n != 2 {
+		t.Errorf("expected 2 candidates queries, got %d", n)
+	}
+	if n := stats["translation"].Count; n != 4 {
+		t.Errorf("expected 4 translation queries, got %d", n)
+	}
+	if n := stats["lookup"].Count; n != 0 {
+		t.Errorf("expected no lookup queries, got %d", n)
+	}
+}
+
+func TestCategories(t *testing.T) {
+	cm, _ := countmin.New(10, 4)
+	db, _ := storage.MakeDB(":memory:", true, &storage.Settings{MaxNGram: 2})
+	defer db.Close()
+	sem, err := newSemanticizer(db, cm, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := hash.NGrams([]string{"Curie"}, 1, 1)[0]
+	for _, q := range []string{
+		`insert into titles values (1, "Marie Curie"), (2, "Curie (unit)"),
+		                           (3, "Curie, Maine")`,
+		`insert into categories (id, name) values (1, "People"),
+		  (2, "Scientists"), (3, "Physicists"), (4, "Units of measurement")`,
+		`insert into subcategories values (2, 1), (3, 2), (1, 3)`,
+		`insert into pagecategories values (1, 3), (2, 4)`,
+	} {
+		if _, err = db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = db.Exec(`insert into linkstats (ngramhash, targetid, count)
+	                  values (?, 1, 3), (?, 2, 1), (?, 3, 1)`, h, h, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	targets := func(opts Options) (targets []string) {
+		all, err := sem.WithOptions(opts).All("Curie")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range all {
+			targets = append(targets, e.Target)
+		}
+		sort.Strings(targets)
+		return
+	}
+
+	for _, c := range []struct {
+		opts    Options
+		targets []string
+	}{
+		{Options{}, []string{"Curie (unit)", "Curie, Maine", "Marie Curie"}},
+		{Options{Categories: []string{"People"}}, nil},
+		{Options{Categories: []string{"People"}, CategoryDepth: 1}, nil},
+		{Options{Categories: []string{"People"}, CategoryDepth: 2},
+			[]string{"Marie Curie"}},
+		{Options{Categories: []string{"Physicists", "Units_of_measurement"}},
+			[]string{"Curie (unit)", "Marie Curie"}},
+	} {
+		if got := targets(c.opts); !reflect.DeepEqual(got, c.targets) {
+			t.Errorf("expected %q for %+v, got %q", c.targets, c.opts, got)
+		}
+	}
+
+	all, err := sem.WithOptions(Options{ShowCategories: true}).All("Curie")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range all {
+		if e.Target == "Marie Curie" &&
+			!reflect.DeepEqual(e.Categories, []string{"Physicists"}) {
+			t.Errorf("wrong categories for Marie Curie: %q", e.Categories)
+		}
+	}
+
+	// The subtree is looked up once, the categories once per anchor.
+	filtered := sem.WithOptions(Options{Categories: []string{"People"},
+		CategoryDepth: 2, ShowCategories: true})
+	before := sem.QueryStats()
+	for i := 0; i < 3; i++ {
+		if _, err = filtered.All("Curie"); err != nil {
+			t.Fatal(err)
+		}
 	}
-	if len(all) != 0 {
-		t.Errorf("expected no entity mentions, got %v", all)
+	after := sem.QueryStats()
+	if n := after["categorytree"].Count - before["categorytree"].Count; n != 0 {
+		t.Errorf("category subtree looked up %d times by All", n)
+	}
+	if n := after["categories"].Count - before["categories"].Count; n != 3 {
+		t.Errorf("expected 3 category queries, got %d", n)
+	}
+}
+
+func TestClosed(t *testing.T) {
+	cm, _ := countmin.New(10, 4)
+	db, _ := storage.MakeDB(":memory:", true, &storage.Settings{MaxNGram: 2})
+	sem, err := newSemanticizer(db, cm, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := sem.WithOptions(Options{ShowCategories: true})
+	if err = sem.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = other.All("Curie"); err != ErrClosed {
+		t.Errorf("expected ErrClosed from All, got %v", err)
+	}
+	if _, err = sem.Lookup("Marie Curie"); err != ErrClosed {
+		t.Errorf("expected ErrClosed from Lookup, got %v", err)
+	}
+	if err = sem.Ping(); err != ErrClosed {
+		t.Errorf("expected ErrClosed from Ping, got %v", err)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	cm, _ := countmin.New(10, 4)
+	db, _ := storage.MakeDB(":memory:", true, &storage.Settings{MaxNGram: 2})
+	defer db.Close()
+	sem, err := newSemanticizer(db, cm, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const abstract = "Marie Curie was a Polish and French physicist."
+	h := hash.NGrams([]string{"Curie"}, 1, 1)[0]
+	for _, q := range []string{
+		`insert into titles values (1, "Marie Curie"), (2, "Curie (unit)")`,
+		`insert into pages (titleid, pageid, length, wikidata, abstract)
+		 values (1, 20408, 100, "Q7186", "` + abstract + `")`,
+		`insert into categories (id, name) values (1, "Physicists")`,
+		`insert into pagecategories values (1, 1)`,
+	} {
+		if _, err = db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = db.Exec(`insert into linkstats (ngramhash, targetid, count)
+	                  values (?, 1, 3), (?, 2, 1)`, h, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := sem.Lookup("Marie Curie")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e == nil || !e.Exists || e.PageID != 20408 || e.Wikidata != "Q7186" ||
+		e.Description != abstract ||
+		!reflect.DeepEqual(e.Categories, []string{"Physicists"}) {
+		t.Errorf("wrong entity for Marie Curie: %+v", e)
+	}
+	if e, err = sem.Lookup("Curie (unit)"); err != nil {
+		t.Fatal(err)
+	} else if e == nil || e.Exists {
+		t.Errorf("expected red link for Curie (unit), got %+v", e)
+	}
+	if e, err = sem.Lookup("Pierre Curie"); err != nil || e != nil {
+		t.Errorf("expected nil for unknown title, got %+v, %v", e, err)
+	}
+
+	for _, descriptions := range []bool{false, true} {
+		all, err := sem.WithOptions(Options{Descriptions: descriptions}).
+			All("Curie")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range all {
+			expected := ""
+			if descriptions && e.Target == "Marie Curie" {
+				expected = abstract
+			}
+			if e.Description != expected {
+				t.Errorf("expected description %q for %q, got %q",
+					expected, e.Target, e.Description)
+			}
+		}
 	}
 }
 
 func TestJSON(t *testing.T) {
-	in := Entity{"Wikipedia", 4, 10, .9, 0.0115, 0, 9}
+	in := Entity{Target: "Wikipedia", PageID: 5043734, Exists: true,
+		Wikidata: "Q52", NGramCount: 4, LinkCount: 10, Commonness: .9, Senseprob: 0.0115,
+		Offset: 0, Length: 9}
 	enc, _ := json.Marshal(in)
 
 	var got Entity
@@ -89,7 +471,8 @@ func TestJSON(t *testing.T) {
 
 	enc = []byte(
 		`{"offset": 0,"target":"Wikipedia", "commonness":0.9,"ngramcount": 4 ,
-		  "linkcount": 10, "length": 9,"senseprob":0.0115}`)
+		  "linkcount": 10, "length": 9,"senseprob":0.0115, "pageid": 5043734,
+		  "exists": true, "wikidata": "Q52"}`)
 	err := json.Unmarshal(enc, &got)
 	if err != nil {
 		t.Error(err)
@@ -122,8 +505,8 @@ func makeSemanticizer2(t *testing.T) (dbname string, sem *Semanticizer,
 	}
 	dbname = dbfile.Name()
 
-	err = dumpparser.Main(dbname, dumppath, "", countmin.MaxRows, 32, 7,
-		testLogger(t))
+	opts := dumpparser.Options{NRows: countmin.MaxRows, NCols: 32, MaxNGram: 7}
+	err = dumpparser.Main(dbname, dumppath, "", &opts, testLogger(t))
 	if err != nil {
 		return
 	}
@@ -144,5 +527,8 @@ func TestEndToEnd(t *testing.T) {
 	}
 	for _, entity := range all {
 		t.Logf("%v", entity)
+		if entity.Target == "Antwerpen (stad)" && !entity.Exists {
+			t.Errorf("expected %q to exist", entity.Target)
+		}
 	}
 }
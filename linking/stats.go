@@ -0,0 +1,73 @@
+package linking
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Kinds of database queries, for QueryStats.
+type queryKind int
+
+const (
+	queryCandidates queryKind = iota
+	queryDisambig
+	queryLang
+	queryCategories
+	queryCategoryTree
+	queryLookup
+	nQueryKinds
+)
+
+var queryNames = [nQueryKinds]string{
+	queryCandidates:   "candidates",
+	queryDisambig:     "disambiguation",
+	queryLang:         "translation",
+	queryCategories:   "categories",
+	queryCategoryTree: "categorytree",
+	queryLookup:       "lookup",
+}
+
+// Counters, updated atomically. Shared by a Semanticizer and its copies.
+type queryStats [nQueryKinds]struct {
+	count, nanos int64
+}
+
+// Record a query of kind k that started at start.
+func (s *queryStats) record(k queryKind, start time.Time) {
+	if s == nil {
+		return
+	}
+	atomic.AddInt64(&s[k].count, 1)
+	atomic.AddInt64(&s[k].nanos, int64(time.Since(start)))
+}
+
+// Run a database query of kind k with f and record the time it takes. f must
+// be done with the result, including closing any rows, when it returns.
+func (sem Semanticizer) timed(k queryKind, f func() error) error {
+	start := time.Now()
+	err := f()
+	sem.stats.record(k, start)
+	return err
+}
+
+// Statistics for one kind of database query.
+type QueryStats struct {
+	Count int64         // Number of queries.
+	Time  time.Duration // Total time spent executing them.
+}
+
+// Returns statistics for the database queries made by sem and all copies of
+// it made by WithOptions, by kind of query. The kinds are "candidates",
+// "disambiguation", "translation", "categories", "categorytree" and "lookup".
+func (sem Semanticizer) QueryStats() map[string]QueryStats {
+	stats := make(map[string]QueryStats, nQueryKinds)
+	for k, name := range queryNames {
+		var qs QueryStats
+		if sem.stats != nil {
+			qs.Count = atomic.LoadInt64(&sem.stats[k].count)
+			qs.Time = time.Duration(atomic.LoadInt64(&sem.stats[k].nanos))
+		}
+		stats[name] = qs
+	}
+	return stats
+}
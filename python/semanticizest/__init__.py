@@ -41,15 +41,42 @@ class Client(object):
         Returns a list of candidate entity links, where each candidate entity
         is represented by a dictionary containing:
          - target     -- Title of the target link
+         - wikidata   -- Wikidata item id of the target, if known
+         - pageviews  -- Popularity of the target in pageview dumps, if known
+         - description -- First paragraph of the target, if requested
          - offset     -- Offset of the anchor on the original sentence
          - length     -- Length of the anchor on the original sentence
          - commonness -- commonness of the link
+         - clickthrough -- share of clicks on the anchor that go to the
+                           target, if known
          - senseprob  -- probability of the link
          - linkcount
          - ngramcount
         '''
         return self._call('all', sentence)
 
+    def _get(self, method):
+        """GET a REST method that returns JSON."""
+        url = os.path.join(self.url, method)
+        return json.loads(urllib2.urlopen(url).read())
+
+    def ready(self):
+        """Check whether the server is up and its model can be queried."""
+        try:
+            self._get('readyz')
+            return True
+        except urllib2.URLError:
+            return False
+
+    def info(self):
+        """Describe the model being served.
+
+        Returns a dictionary with the settings the model was built with
+        (settings), the number of rows in each database table (tables) and
+        the dimensions of the n-gram count sketch (sketch).
+        """
+        return self._get('info')
+
 
 class Semanticizer(Client):
     """Entity linker.
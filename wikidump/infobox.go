@@ -0,0 +1,154 @@
+package wikidump
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Prefixes of the names of infobox templates on various Wikipedias.
+var DefaultInfoboxPrefixes = []string{"Infobox", "Taxobox", "Ficha de",
+	"Info/", "Carrousel"}
+
+// Returns the templates that are infoboxes, i.e., whose names start with one
+// of prefixes (compared case-insensitively).
+func Infoboxes(templates, prefixes []string) []string {
+	var boxes []string
+	for _, t := range templates {
+		for _, p := range prefixes {
+			if hasPrefixFold(t, p) {
+				boxes = append(boxes, t)
+				break
+			}
+		}
+	}
+	return boxes
+}
+
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+// Mapping from infobox template names to coarse entity types, such as PER,
+// LOC, ORG and MISC.
+type InfoboxTypes struct {
+	rules []infoboxRule
+}
+
+type infoboxRule struct {
+	name   string
+	prefix bool // name is a prefix
+	typ    string
+}
+
+// Default mapping for English and Dutch Wikipedia. Infoboxes not mentioned
+// get type MISC.
+var DefaultInfoboxTypes = mustReadInfoboxTypes(`
+# English Wikipedia.
+Infobox person	PER
+Infobox officeholder	PER
+Infobox scientist	PER
+Infobox writer	PER
+Infobox musical artist	PER
+Infobox artist	PER
+Infobox football biography	PER
+Infobox sportsperson	PER
+Infobox actor	PER
+Infobox royalty	PER
+Infobox military person	PER
+Infobox settlement	LOC
+Infobox country	LOC
+Infobox river	LOC
+Infobox mountain	LOC
+Infobox lake	LOC
+Infobox island	LOC
+Infobox building	LOC
+Infobox station	LOC
+Infobox protected area	LOC
+Infobox company	ORG
+Infobox organization	ORG
+Infobox university	ORG
+Infobox school	ORG
+Infobox political party	ORG
+Infobox football club	ORG
+Infobox sports team	ORG
+Infobox band	ORG
+
+# Dutch Wikipedia.
+Infobox persoon	PER
+Infobox artiest	PER
+Infobox politicus	PER
+Infobox voetballer	PER
+Infobox wielrenner	PER
+Infobox plaats*	LOC
+Infobox land	LOC
+Infobox rivier	LOC
+Infobox berg	LOC
+Infobox gebergte	LOC
+Infobox gemeente*	LOC
+Infobox bedrijf	ORG
+Infobox organisatie	ORG
+Infobox universiteit	ORG
+Infobox politieke partij	ORG
+Infobox voetbalclub	ORG
+Infobox band	ORG
+
+*	MISC
+`)
+
+func mustReadInfoboxTypes(s string) *InfoboxTypes {
+	types, err := ReadInfoboxTypes(strings.NewReader(s))
+	if err != nil {
+		panic(err)
+	}
+	return types
+}
+
+// Read a mapping from infobox names to types. Each line holds a template
+// name, a tab and a type. A name ending in "*" matches all templates that
+// start with the rest of it, so "*" alone matches any infobox. Blank lines
+// and lines starting with "#" are ignored.
+//
+// Rules are tried in order; the first match wins. Names are compared
+// case-insensitively, and underscores are treated as spaces.
+func ReadInfoboxTypes(r io.Reader) (*InfoboxTypes, error) {
+	types := new(InfoboxTypes)
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tab := strings.LastIndex(line, "\t")
+		if tab == -1 {
+			return nil, fmt.Errorf("line %d of infobox types: no tab in %q",
+				lineno, line)
+		}
+		rule := infoboxRule{
+			name: normSpace(line[:tab]),
+			typ:  strings.TrimSpace(line[tab+1:]),
+		}
+		if strings.HasSuffix(rule.name, "*") {
+			rule.prefix = true
+			rule.name = strings.TrimSpace(strings.TrimSuffix(rule.name, "*"))
+		}
+		types.rules = append(types.rules, rule)
+	}
+	return types, scanner.Err()
+}
+
+// Returns the type of the first of infoboxes that has one, or the empty
+// string if none has.
+func (types *InfoboxTypes) Type(infoboxes []string) string {
+	for _, box := range infoboxes {
+		box = normSpace(box)
+		for _, rule := range types.rules {
+			if rule.prefix && hasPrefixFold(box, rule.name) ||
+				strings.EqualFold(box, rule.name) {
+				return rule.typ
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,51 @@
+package wikidump
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInfoboxes(t *testing.T) {
+	templates := Templates("{{Infobox person|name=Ada}}{{cite web|url=x}}" +
+		"{{infobox_scientist}}{{Taxobox|regnum=Animalia}}")
+	expected := []string{"Infobox person", "Infobox scientist", "Taxobox"}
+	boxes := Infoboxes(templates, DefaultInfoboxPrefixes)
+	if !reflect.DeepEqual(boxes, expected) {
+		t.Errorf("expected %q, got %q", expected, boxes)
+	}
+}
+
+func TestInfoboxTypes(t *testing.T) {
+	types, err := ReadInfoboxTypes(strings.NewReader(
+		"# comment\n\nInfobox person\tPER\ninfobox_football*\tORG\n" +
+			"Infobox*\tMISC\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		boxes []string
+		typ   string
+	}{
+		{[]string{"Infobox person"}, "PER"},
+		{[]string{"Infobox Football club"}, "ORG"},
+		{[]string{"Infobox planet"}, "MISC"},
+		{[]string{"Taxobox", "Infobox person"}, "PER"},
+		{[]string{"Taxobox"}, ""},
+		{nil, ""},
+	} {
+		if typ := types.Type(c.boxes); typ != c.typ {
+			t.Errorf("expected %q for %q, got %q", c.typ, c.boxes, typ)
+		}
+	}
+
+	typ := DefaultInfoboxTypes.Type([]string{"Infobox plaats in Nederland"})
+	if typ != "LOC" {
+		t.Errorf("expected LOC, got %q", typ)
+	}
+
+	_, err = ReadInfoboxTypes(strings.NewReader("Infobox person PER\n"))
+	if err == nil {
+		t.Error("no error for line without tab")
+	}
+}
@@ -1,13 +1,23 @@
 package wikidump
 
 import (
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
 	"encoding/xml"
 	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
 )
 
 // A Wikipedia page.
 type Page struct {
 	Title, Text string
+	ID          int64     // Page id.
+	Timestamp   time.Time // Time of the revision in the dump.
+	Namespace   int       // Namespace key; 0 for articles.
 }
 
 // A Wikipedia redirect to Target.
@@ -17,9 +27,14 @@ type Redirect struct {
 
 // Parse out a single page or redirect. Assumes a <page> start tag has just
 // been consumed.
-func parsePage(d *xml.Decoder, pages chan<- *Page, redirs chan<- *Redirect) {
-	var mainNS bool
+func parsePage(d *xml.Decoder, pages chan<- *Page, redirs chan<- *Redirect,
+	extraNS []int) {
+
+	var mainNS, wantNS, inRevision bool
 	var text, title string
+	var id int64
+	var ns int
+	var timestamp time.Time
 
 	for {
 		t, err := d.Token()
@@ -31,8 +46,21 @@ func parsePage(d *xml.Decoder, pages chan<- *Page, redirs chan<- *Redirect) {
 		case xml.StartElement:
 			switch tok.Name.Local {
 			case "ns":
-				ns := getText(d)
-				mainNS = string(ns) == "0"
+				ns, _ = strconv.Atoi(getText(d))
+				mainNS = ns == 0
+				wantNS = mainNS
+				for _, key := range extraNS {
+					wantNS = wantNS || ns == key
+				}
+			case "id":
+				// Revisions and contributors have ids as well.
+				if !inRevision {
+					id, _ = strconv.ParseInt(getText(d), 10, 64)
+				}
+			case "revision":
+				inRevision = true
+			case "timestamp":
+				timestamp, _ = time.Parse(time.RFC3339, getText(d))
 			case "redirect":
 				if mainNS {
 					for _, attr := range tok.Attr {
@@ -43,7 +71,7 @@ func parsePage(d *xml.Decoder, pages chan<- *Page, redirs chan<- *Redirect) {
 					}
 				}
 			case "text":
-				if mainNS {
+				if wantNS {
 					text = getText(d)
 				}
 			case "title":
@@ -54,8 +82,9 @@ func parsePage(d *xml.Decoder, pages chan<- *Page, redirs chan<- *Redirect) {
 
 		case xml.EndElement:
 			if tok.Name.Local == "page" {
-				if mainNS {
-					pages <- &Page{title, text}
+				if wantNS {
+					pages <- &Page{Title: title, Text: text, ID: id,
+						Timestamp: timestamp, Namespace: ns}
 				}
 				return
 			}
@@ -79,11 +108,50 @@ func getText(d *xml.Decoder) (text string) {
 	return text
 }
 
+// Open a dump file, decompressing it if its name ends in .bz2 or .gz.
+func Open(path string) (r io.ReadCloser, err error) {
+	rf, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	r = struct {
+		*bufio.Reader
+		io.Closer
+	}{bufio.NewReader(rf), rf}
+	switch filepath.Ext(path) {
+	case ".bz2":
+		r = struct {
+			io.Reader
+			io.Closer
+		}{bzip2.NewReader(r), rf}
+	case ".gz":
+		var gz *gzip.Reader
+		if gz, err = gzip.NewReader(r); err != nil {
+			rf.Close()
+			return nil, err
+		}
+		r = struct {
+			io.Reader
+			io.Closer
+		}{gz, rf}
+	}
+	return
+}
+
 // Get pages and redirects from wikidump r. Only retrieves the pages in the
 // main namespace.
 //
 // XXX needs cleaner error handling. Currently panics.
 func GetPages(r io.Reader, pages chan<- *Page, redirs chan<- *Redirect) {
+	GetPagesNS(r, pages, redirs)
+}
+
+// Like GetPages, but also retrieves the pages in the namespaces with the
+// given keys, e.g., 14 for categories. Redirects are only retrieved from the
+// main namespace.
+func GetPagesNS(r io.Reader, pages chan<- *Page, redirs chan<- *Redirect,
+	namespaces ...int) {
+
 	d := xml.NewDecoder(r)
 
 	defer close(pages)
@@ -100,7 +168,7 @@ func GetPages(r io.Reader, pages chan<- *Page, redirs chan<- *Redirect) {
 		tok, ok := t.(xml.StartElement)
 		if ok {
 			if tok.Name.Local == "page" {
-				parsePage(d, pages, redirs)
+				parsePage(d, pages, redirs, namespaces)
 			}
 		}
 	}
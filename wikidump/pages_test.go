@@ -7,6 +7,7 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestGetPages(t *testing.T) {
@@ -23,6 +24,15 @@ func TestGetPages(t *testing.T) {
 	wg.Add(2)
 	go func() {
 		for p := range pages {
+			if p.Title == "Albert Speer" {
+				ts := time.Date(2014, 9, 17, 16, 54, 12, 0, time.UTC)
+				if p.ID != 1 {
+					t.Errorf("expected page id 1, got %d", p.ID)
+				}
+				if !p.Timestamp.Equal(ts) {
+					t.Errorf("expected timestamp %v, got %v", ts, p.Timestamp)
+				}
+			}
 			titles = append(titles, p.Title)
 			if strings.HasPrefix(p.Title, "Empty text") && p.Text != "" {
 				t.Errorf("empty text not handled correctly, got %q", p.Text)
@@ -0,0 +1,135 @@
+package wikidump
+
+import (
+	"bufio"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Read view counts from a Wikimedia pageview or clickstream dump, using
+// DefaultSiteInfo. See SiteInfo.ReadPageviews.
+func ReadPageviews(r io.Reader, project string,
+	f func(title string, count int64) error) error {
+
+	return DefaultSiteInfo.ReadPageviews(r, project, f)
+}
+
+// Read view counts from a Wikimedia pageview or clickstream dump and call f
+// on each title and count in it. The same title may occur many times.
+//
+// Three formats are recognized, line by line:
+//
+//	en Main_Page 242332 0                    hourly pageviews (or pagecounts)
+//	en.wikipedia Main_Page 15580374 desktop 1234 A1B2  pageviews-complete
+//	other-search<TAB>Main_Page<TAB>external<TAB>1234   clickstream
+//
+// For pageview dumps, only lines for project are used. project is a language
+// code such as "en"; its mobile version ("en.m") and the long form
+// ("en.wikipedia", "en.m.wikipedia") also match. If project is empty, all
+// lines are used. Clickstream dumps cover a single wiki; their counts are
+// ascribed to the page clicked through to.
+//
+// Titles are returned with underscores replaced by spaces, percent-escapes
+// decoded and capitalized according to si's case rule, since pageview dumps
+// record titles as requested. Malformed lines are skipped.
+func (si *SiteInfo) ReadPageviews(r io.Reader, project string,
+	f func(title string, count int64) error) error {
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if strings.IndexByte(line, '\t') != -1 {
+			_, to, _, n, ok := splitClickstream(line)
+			if ok {
+				if err := f(to, n); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		var title, count string
+		fields := strings.Fields(line)
+		switch len(fields) {
+		case 4:
+			title, count = fields[1], fields[2]
+		case 6:
+			title, count = fields[1], fields[4]
+		default:
+			continue
+		}
+		if project != "" && !isProject(fields[0], project) {
+			continue
+		}
+
+		n, err := strconv.ParseInt(count, 10, 64)
+		if err != nil || n <= 0 {
+			continue
+		}
+		title = si.normalizeTitle(unescapeTitle(title), 0)
+		if title == "" {
+			continue
+		}
+		if err = f(title, n); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func isProject(domain, project string) bool {
+	switch strings.TrimPrefix(domain, project) {
+	case "", ".m", ".wikipedia", ".m.wikipedia":
+		return strings.HasPrefix(domain, project)
+	}
+	return false
+}
+
+func unescapeTitle(title string) string {
+	if strings.IndexByte(title, '%') != -1 {
+		// QueryUnescape would turn "+" into a space.
+		s := strings.Replace(title, "+", "%2B", -1)
+		if s, err := url.QueryUnescape(s); err == nil {
+			title = s
+		}
+	}
+	return strings.TrimSpace(strings.Replace(title, "_", " ", -1))
+}
+
+// Read a Wikipedia clickstream dump, a TSV file with the columns prev, curr,
+// type and n, and call f on the rows with the given type. For type "link",
+// these record the number of times, n, that readers followed a link from
+// one article to another.
+//
+// Titles are returned as by ReadPageviews. Malformed lines are skipped.
+func ReadClickstream(r io.Reader, typ string,
+	f func(from, to string, n int64) error) error {
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		from, to, t, n, ok := splitClickstream(scanner.Text())
+		if !ok || t != typ {
+			continue
+		}
+		if err := f(from, to, n); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func splitClickstream(line string) (from, to, typ string, n int64, ok bool) {
+	fields := strings.Split(line, "\t")
+	if len(fields) != 4 {
+		return
+	}
+	n, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil || n <= 0 {
+		return
+	}
+	from, to = unescapeTitle(fields[0]), unescapeTitle(fields[1])
+	return from, to, fields[2], n, to != ""
+}
@@ -0,0 +1,72 @@
+package wikidump
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadPageviews(t *testing.T) {
+	const dump = "en Main_Page 242332 0\n" +
+		"en.m Ada_Lovelace 10 0\n" +
+		"nl Ada_Lovelace 5 0\n" +
+		"en.b Ada_Lovelace 7 0\n" +
+		"en AT%26T 3 0\n" +
+		"en C++ 2 0\n" +
+		"en ada_Lovelace 4 0\n" +
+		"en.wikipedia Ada_Lovelace 1234 desktop 20 A20\n" +
+		"en.wikipedia Null 5678 mobile-web 0 \n" +
+		"garbage\n" +
+		"other-search\tAda_Lovelace\texternal\t100\n"
+
+	type view struct {
+		title string
+		count int64
+	}
+	var views []view
+	err := ReadPageviews(strings.NewReader(dump), "en",
+		func(title string, count int64) error {
+			views = append(views, view{title, count})
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []view{
+		{"Main Page", 242332},
+		{"Ada Lovelace", 10},
+		{"AT&T", 3},
+		{"C++", 2},
+		{"Ada Lovelace", 4},
+		{"Ada Lovelace", 20},
+		{"Ada Lovelace", 100},
+	}
+	if !reflect.DeepEqual(views, expected) {
+		t.Errorf("expected %v, got %v", expected, views)
+	}
+}
+
+func TestReadClickstream(t *testing.T) {
+	const dump = "other-search\tAda_Lovelace\texternal\t100\n" +
+		"Charles_Babbage\tAda_Lovelace\tlink\t42\n" +
+		"Ada_Lovelace\tAnalytical_Engine\tlink\t7\n" +
+		"Ada_Lovelace\tNote_G\tother\t3\n" +
+		"Ada_Lovelace\tBroken\tlink\tmany\n"
+
+	var clicks []string
+	err := ReadClickstream(strings.NewReader(dump), "link",
+		func(from, to string, n int64) error {
+			clicks = append(clicks, fmt.Sprintf("%s -> %s: %d", from, to, n))
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"Charles Babbage -> Ada Lovelace: 42",
+		"Ada Lovelace -> Analytical Engine: 7"}
+	if !reflect.DeepEqual(clicks, expected) {
+		t.Errorf("expected %q, got %q", expected, clicks)
+	}
+}
@@ -0,0 +1,287 @@
+package wikidump
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A link in plain text rendered from wikitext. Start and End are byte
+// offsets into the text; text[Start:End] is the anchor text.
+type LinkSpan struct {
+	Start  int    `json:"start"`
+	End    int    `json:"end"`
+	Target string `json:"target"`
+}
+
+var (
+	comment    = regexp.MustCompile(`(?s)<!--.*?(-->|$)`)
+	refElement = regexp.MustCompile(
+		`(?is)<ref(\s[^>]*)?/>|<ref(\s[^>]*)?>.*?(</ref\s*>|$)`)
+	lineBreak    = regexp.MustCompile(`(?i)<br\s*/?>`)
+	selfClosing  = regexp.MustCompile(`<[a-z][^>]*/>`)
+	quotes       = regexp.MustCompile(`'{2,}`)
+	heading      = regexp.MustCompile(`^(=+)\s*(.*?)\s*(=+)\s*$`)
+	listMarker   = regexp.MustCompile(`^[*#:;]+\s*`)
+	rule         = regexp.MustCompile(`^-{4,}\s*$`)
+	externalLink = regexp.MustCompile(`\[(?:https?:)?//[^\s\]]+\s*([^\]]*)\]`)
+)
+
+// Renders wikitext as plain text, using DefaultSiteInfo.
+func PlainText(s string) (text string, links []LinkSpan) {
+	return DefaultSiteInfo.PlainText(s)
+}
+
+// Renders wikitext as plain text. Returns the text and the spans of the
+// links to main-namespace pages in it, in order of appearance.
+//
+// Comments, references, templates, tables and other markup removed by Cleanup
+// do not appear in the output, nor do bold/italic quotes, heading markers,
+// list markers and horizontal rules. Links are replaced by their anchor
+// text; file and category links are removed entirely. External links are
+// replaced by their labels.
+func (si *SiteInfo) PlainText(s string) (text string, links []LinkSpan) {
+	s = quotes.ReplaceAllString(si.removeMarkup(s), "")
+	s = externalLink.ReplaceAllString(s, "$1")
+
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if m := heading.FindStringSubmatch(line); m != nil {
+			line = m[2]
+		} else if rule.MatchString(line) {
+			line = ""
+		} else {
+			line = listMarker.ReplaceAllString(line, "")
+		}
+		lines[i] = line
+	}
+	text, links = si.renderLinks(strings.Join(lines, "\n"))
+	return squeezeLines(text, links)
+}
+
+// Collapse runs of blank lines, which removed markup tends to leave behind,
+// and trim surrounding whitespace, adjusting the link spans to match.
+func squeezeLines(s string, links []LinkSpan) (string, []LinkSpan) {
+	out := bytes.NewBuffer(make([]byte, 0, len(s)))
+	// newpos[i] is the offset in out of s[i].
+	newpos := make([]int, len(s)+1)
+	start := len(s) - len(strings.TrimLeftFunc(s, unicode.IsSpace))
+	end := len(strings.TrimRightFunc(s, unicode.IsSpace))
+
+	newlines := 0
+	for i := 0; i < len(s); i++ {
+		newpos[i] = out.Len()
+		if i < start || i >= end {
+			continue
+		}
+		if s[i] == '\n' {
+			newlines++
+			if newlines > 2 {
+				continue
+			}
+		} else {
+			newlines = 0
+		}
+		out.WriteByte(s[i])
+	}
+	newpos[len(s)] = out.Len()
+
+	for i := range links {
+		links[i].Start = newpos[links[i].Start]
+		links[i].End = newpos[links[i].End]
+	}
+	return out.String(), links
+}
+
+// Remove comments, references, and everything that Cleanup removes.
+func (si *SiteInfo) removeMarkup(s string) string {
+	s = comment.ReplaceAllString(s, "")
+	s = refElement.ReplaceAllString(s, "")
+	s = lineBreak.ReplaceAllString(s, "\n")
+	// Cleanup treats these as start tags without an end tag.
+	s = selfClosing.ReplaceAllString(s, "")
+	text, _ := si.cleanup(s, 0)
+	return text
+}
+
+var (
+	bold      = regexp.MustCompile(`'''(.+?)'''`)
+	paragraph = regexp.MustCompile(`\n\s*\n`)
+)
+
+// Returns the phrases set in bold in the first paragraph of an article, using
+// DefaultSiteInfo.
+func LeadAliases(s string) []string {
+	return DefaultSiteInfo.LeadAliases(s)
+}
+
+// Returns the phrases set in bold in the first paragraph of an article, as
+// plain text and without duplicates. By convention, these are the names of
+// the article's subject, e.g., both "Holland" and "the Netherlands" in the
+// lead of the Netherlands article.
+func (si *SiteInfo) LeadAliases(s string) []string {
+	var aliases []string
+	seen := make(map[string]bool)
+	for _, m := range bold.FindAllStringSubmatch(si.lead(s), -1) {
+		alias, _ := si.PlainText(m[1])
+		alias = strings.Join(strings.Fields(alias), " ")
+		if alias != "" && !seen[alias] {
+			seen[alias] = true
+			aliases = append(aliases, alias)
+		}
+	}
+	return aliases
+}
+
+// Returns the first paragraph of an article as plain text, truncated to at
+// most maxLen bytes, using DefaultSiteInfo.
+func Abstract(s string, maxLen int) string {
+	return DefaultSiteInfo.Abstract(s, maxLen)
+}
+
+// Returns the first paragraph of an article as plain text, with whitespace
+// collapsed, for use as a short description of its subject. If it is longer
+// than maxLen bytes, it is cut at the last word boundary that fits and
+// marked with an ellipsis. maxLen <= 0 means no limit.
+func (si *SiteInfo) Abstract(s string, maxLen int) string {
+	text, _ := si.PlainText(si.lead(s))
+	text = strings.Join(strings.Fields(text), " ")
+	if maxLen <= 0 || len(text) <= maxLen {
+		return text
+	}
+
+	ellipsis := "..."
+	if maxLen < len(ellipsis) {
+		ellipsis = "" // No room for it.
+	}
+	cut := maxLen - len(ellipsis)
+	if space := strings.LastIndex(text[:cut+1], " "); space > 0 {
+		cut = space
+	} else {
+		// No word boundary; don't split a UTF-8 sequence.
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+	}
+	return strings.TrimRight(text[:cut], ",;:") + ellipsis
+}
+
+// Returns the first paragraph of running text in s, with markup removed as
+// by removeMarkup. Headings and paragraphs consisting only of file links
+// are skipped.
+func (si *SiteInfo) lead(s string) string {
+	for _, para := range paragraph.Split(si.removeMarkup(s), -1) {
+		para = strings.TrimSpace(para)
+		if para == "" || strings.HasPrefix(para, "=") {
+			continue
+		}
+		if text, _ := si.PlainText(para); text != "" {
+			return para
+		}
+	}
+	return ""
+}
+
+// Replace wikilinks by their anchor text, recording their positions.
+func (si *SiteInfo) renderLinks(s string) (string, []LinkSpan) {
+	var links []LinkSpan
+	out := bytes.NewBuffer(make([]byte, 0, len(s)))
+
+	for {
+		open := strings.Index(s, "[[")
+		if open == -1 {
+			out.WriteString(s)
+			break
+		}
+		out.WriteString(s[:open])
+		s = s[open+2:]
+
+		end := matchingBrackets(s)
+		if end == -1 {
+			// Unclosed link; render the rest verbatim.
+			out.WriteString("[[")
+			out.WriteString(s)
+			break
+		}
+		mid := s[:end]
+		s = s[end+2:]
+
+		target, anchor := mid, mid
+		if pipe := strings.IndexByte(mid, '|'); pipe != -1 {
+			target, anchor = mid[:pipe], mid[pipe+1:]
+		} else if t := strings.TrimSpace(mid); strings.HasPrefix(t, ":") {
+			anchor = t[1:]
+		}
+
+		title, ok := si.normalizeTarget(target)
+		if ok && strings.Contains(anchor, "[[") {
+			// Nested links only occur in file links (or errors).
+			ok = false
+		}
+		if !ok {
+			if si.isHidden(target) {
+				continue
+			}
+			// Link to another namespace or wiki: keep the anchor text.
+			anchor, _ = si.renderLinks(anchor)
+			out.WriteString(anchor)
+			continue
+		}
+
+		// Link trail: "[[bus]]es" has anchor text "buses".
+		trail := 0
+		for trail < len(s) && isLetter(s[trail]) {
+			trail++
+		}
+		anchor, s = anchor+s[:trail], s[trail:]
+
+		start := out.Len()
+		out.WriteString(anchor)
+		links = append(links, LinkSpan{start, out.Len(), title})
+	}
+	return out.String(), links
+}
+
+// Reports whether a link to target is not rendered in the running text,
+// as is the case for (non-colon) file and category links and interlanguage
+// links.
+func (si *SiteInfo) isHidden(target string) bool {
+	target = strings.TrimSpace(target)
+	colon := strings.IndexByte(target, ':')
+	if colon <= 0 {
+		return false
+	}
+	prefix := target[:colon]
+	if key, ok := si.namespace(prefix); ok {
+		return key == 6 || key == 14
+	}
+	return isLanguageCode(prefix)
+}
+
+// Returns the index of the "]]" that closes a link whose content starts at
+// s[0], skipping nested links. Returns -1 if there is none.
+func matchingBrackets(s string) int {
+	depth := 0
+	for i := 0; i+1 < len(s); i++ {
+		switch s[i : i+2] {
+		case "[[":
+			depth++
+			i++
+		case "]]":
+			if depth == 0 {
+				return i
+			}
+			depth--
+			i++
+		}
+	}
+	return -1
+}
+
+// ASCII letters only, as in MediaWiki's default link trail.
+func isLetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
@@ -0,0 +1,139 @@
+package wikidump
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPlainText(t *testing.T) {
+	const page = `{{Infobox person|name=Ada}}
+'''Ada Lovelace'''<ref name="bio"/> was an English [[mathematician]]s
+and writer,<!-- check this --> known for her work on
+[[Charles Babbage|Babbage's]] ''[[Analytical Engine]]''.<ref>Some
+[[Reference|ref]].</ref>
+
+== Early life ==
+[[File:Ada.jpg|thumb|A [[portrait]] of Ada]]
+* Born in [[London]]<br/>in 1815.
+----
+See [http://example.com the website] and [[Wikipedia:About|this]].
+[[Category:Mathematicians]]
+[[fr:Ada Lovelace]]`
+
+	const expected = `Ada Lovelace was an English mathematicians
+and writer, known for her work on
+Babbage's Analytical Engine.
+
+Early life
+
+Born in London
+in 1815.
+
+See the website and this.`
+
+	text, links := PlainText(page)
+	if text != expected {
+		t.Errorf("expected %q, got %q", expected, text)
+	}
+
+	var targets, anchors []string
+	for _, l := range links {
+		targets = append(targets, l.Target)
+		anchors = append(anchors, text[l.Start:l.End])
+	}
+	expTargets := []string{"Mathematician", "Charles Babbage",
+		"Analytical Engine", "London"}
+	expAnchors := []string{"mathematicians", "Babbage's",
+		"Analytical Engine", "London"}
+	if !reflect.DeepEqual(targets, expTargets) {
+		t.Errorf("expected targets %q, got %q", expTargets, targets)
+	}
+	if !reflect.DeepEqual(anchors, expAnchors) {
+		t.Errorf("expected anchors %q, got %q", expAnchors, anchors)
+	}
+}
+
+func TestPlainTextSample(t *testing.T) {
+	f, err := os.Open("nlwiki-20140927-sample.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	si, err := ReadSiteInfo(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Seek(0, 0)
+
+	pages, redirs := make(chan *Page), make(chan *Redirect)
+	go GetPages(f, pages, redirs)
+	go func() {
+		for _ = range redirs {
+		}
+	}()
+
+	for p := range pages {
+		text, links := si.PlainText(p.Text)
+		for _, l := range links {
+			if l.Start < 0 || l.End > len(text) || l.Start > l.End {
+				t.Fatalf("invalid span %v in %q", l, p.Title)
+			}
+		}
+		for _, markup := range []string{"'''", "{{", "<ref", "[["} {
+			if strings.Contains(text, markup) {
+				t.Errorf("%q left in rendering of %q", markup, p.Title)
+			}
+		}
+	}
+}
+
+func TestLeadAliases(t *testing.T) {
+	for _, c := range []struct {
+		text    string
+		aliases []string
+	}{
+		{
+			text: "{{Infobox country}}\n[[File:Flag.svg|thumb|'''Flag''']]\n\n" +
+				"'''Holland''', officially '''the [[Netherlands]]''' " +
+				"('''''Nederland'''''),<ref>'''Not''' this</ref> is a " +
+				"country. '''Holland''' is flat.\n\n" +
+				"== History ==\n'''Later''' paragraphs are ignored.",
+			aliases: []string{"Holland", "the Netherlands", "Nederland"},
+		},
+		{
+			text:    "No bold text here.\n\n'''Nor''' here.",
+			aliases: nil,
+		},
+	} {
+		aliases := LeadAliases(c.text)
+		if !reflect.DeepEqual(aliases, c.aliases) {
+			t.Errorf("expected %q, got %q", c.aliases, aliases)
+		}
+	}
+}
+
+func TestAbstract(t *testing.T) {
+	const page = "{{Infobox person}}\n'''Ada Lovelace''' was an English " +
+		"[[mathematician]] and writer,\nknown for her work on the " +
+		"[[Analytical Engine]].\n\n== Life ==\nBorn in London."
+
+	for _, c := range []struct {
+		maxLen   int
+		expected string
+	}{
+		{0, "Ada Lovelace was an English mathematician and writer, " +
+			"known for her work on the Analytical Engine."},
+		{60, "Ada Lovelace was an English mathematician and writer..."},
+		{10, "Ada..."},
+		{5, "Ad..."},
+		{2, "Ad"},
+	} {
+		if a := Abstract(page, c.maxLen); a != c.expected {
+			t.Errorf("expected %q, got %q", c.expected, a)
+		} else if c.maxLen > 0 && len(a) > c.maxLen {
+			t.Errorf("%q longer than %d bytes", a, c.maxLen)
+		}
+	}
+}
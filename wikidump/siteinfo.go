@@ -0,0 +1,257 @@
+package wikidump
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A namespace, as declared in a dump's <siteinfo>.
+type Namespace struct {
+	Key  int    `xml:"key,attr"`
+	Case string `xml:"case,attr"`
+	Name string `xml:",chardata"`
+}
+
+// Site information from the <siteinfo> element of a dump.
+type SiteInfo struct {
+	Sitename string `xml:"sitename"`
+	DBName   string `xml:"dbname"` // E.g., "enwiki".
+	Base     string `xml:"base"`   // URL of the main page.
+
+	// Capitalization rule for titles: "first-letter" or "case-sensitive".
+	Case string `xml:"case"`
+
+	// The canonical (English) namespace names are always recognized, in
+	// addition to these.
+	Namespaces []Namespace `xml:"namespaces>namespace"`
+
+	// Additional names for namespaces, mapped to namespace keys. Dumps
+	// don't list these; ReadSiteInfo fills them in from <namespacealiases>,
+	// if present, and from the aliases Wikimedia configures for some wikis.
+	Aliases map[string]int `xml:"-"`
+}
+
+// Namespace aliases of some Wikimedia wikis, by database name. Dumps don't
+// list these, but articles use them in links.
+var wikiAliases = map[string]map[string]int{
+	"enwiki": {"WP": 4, "WT": 5},
+	"nlwiki": {"WP": 4, "G": 2, "Afbeelding": 6, "Overleg afbeelding": 7},
+}
+
+// Canonical namespace names. MediaWiki accepts these on every wiki, in
+// addition to the localized names.
+var canonicalNamespaces = map[string]int{
+	"media":          -2,
+	"special":        -1,
+	"talk":           1,
+	"user":           2,
+	"user talk":      3,
+	"project":        4,
+	"project talk":   5,
+	"file":           6,
+	"image":          6,
+	"file talk":      7,
+	"image talk":     7,
+	"mediawiki":      8,
+	"mediawiki talk": 9,
+	"template":       10,
+	"template talk":  11,
+	"help":           12,
+	"help talk":      13,
+	"category":       14,
+	"category talk":  15,
+}
+
+// Site information for English Wikipedia. Used by ExtractLinks.
+var DefaultSiteInfo = &SiteInfo{
+	Sitename: "Wikipedia",
+	DBName:   "enwiki",
+	Base:     "https://en.wikipedia.org/wiki/Main_Page",
+	Case:     "first-letter",
+	Namespaces: []Namespace{
+		{Key: 0, Case: "first-letter"},
+		{Key: 4, Case: "first-letter", Name: "Wikipedia"},
+		{Key: 5, Case: "first-letter", Name: "Wikipedia talk"},
+		{Key: 100, Case: "first-letter", Name: "Portal"},
+		{Key: 101, Case: "first-letter", Name: "Portal talk"},
+		{Key: 108, Case: "first-letter", Name: "Book"},
+		{Key: 109, Case: "first-letter", Name: "Book talk"},
+		{Key: 118, Case: "first-letter", Name: "Draft"},
+		{Key: 119, Case: "first-letter", Name: "Draft talk"},
+		{Key: 710, Case: "first-letter", Name: "TimedText"},
+		{Key: 711, Case: "first-letter", Name: "TimedText talk"},
+		{Key: 828, Case: "first-letter", Name: "Module"},
+		{Key: 829, Case: "first-letter", Name: "Module talk"},
+	},
+	Aliases: wikiAliases["enwiki"],
+}
+
+// Read the <siteinfo> element from the start of a dump. Consumes r up to and
+// including the </siteinfo> end tag.
+func ReadSiteInfo(r io.Reader) (*SiteInfo, error) {
+	d := xml.NewDecoder(r)
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			return nil, errors.New("no <siteinfo> in dump")
+		} else if err != nil {
+			return nil, err
+		}
+
+		tok, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch tok.Name.Local {
+		case "siteinfo":
+			// <namespacealiases> appears in siteinfo from the API.
+			var raw struct {
+				SiteInfo
+				NSAliases []struct {
+					Key  int    `xml:"id,attr"`
+					Name string `xml:",chardata"`
+				} `xml:"namespacealiases>ns"`
+			}
+			if err = d.DecodeElement(&raw, &tok); err != nil {
+				return nil, err
+			}
+			si := &raw.SiteInfo
+			si.Aliases = make(map[string]int)
+			for alias, key := range wikiAliases[si.DBName] {
+				si.Aliases[alias] = key
+			}
+			for _, a := range raw.NSAliases {
+				si.Aliases[a.Name] = a.Key
+			}
+			return si, nil
+		case "page":
+			return nil, errors.New("no <siteinfo> before first <page>")
+		}
+	}
+}
+
+// Returns the key of the namespace with the given local or canonical name,
+// or alias.
+func (si *SiteInfo) namespace(name string) (key int, ok bool) {
+	name = normSpace(name)
+	if name == "" {
+		return 0, false
+	}
+	for _, ns := range si.Namespaces {
+		if ns.Name != "" && strings.EqualFold(ns.Name, name) {
+			return ns.Key, true
+		}
+	}
+	for alias, key := range si.Aliases {
+		if strings.EqualFold(alias, name) {
+			return key, true
+		}
+	}
+	key, ok = canonicalNamespaces[strings.ToLower(name)]
+	return
+}
+
+// Capitalization rule for the main namespace.
+func (si *SiteInfo) mainCase() string {
+	return si.caseOf(0)
+}
+
+// Capitalization rule for the namespace with the given key.
+func (si *SiteInfo) caseOf(key int) string {
+	for _, ns := range si.Namespaces {
+		if ns.Key == key && ns.Case != "" {
+			return ns.Case
+		}
+	}
+	return si.Case
+}
+
+// Interwiki prefixes for Wikimedia projects. Language codes are in
+// languageCodes.
+var interwikiPrefixes = map[string]bool{
+	"b": true, "c": true, "commons": true, "d": true, "foundation": true,
+	"m": true, "meta": true, "mw": true, "mediawikiwiki": true, "n": true,
+	"phab": true, "q": true, "s": true, "species": true, "v": true,
+	"voy": true, "w": true, "wikibooks": true, "wikidata": true,
+	"wikimedia": true, "wikinews": true, "wikipedia": true,
+	"wikiquote": true, "wikisource": true, "wikispecies": true,
+	"wikiversity": true, "wikivoyage": true, "wikt": true,
+	"wiktionary": true, "wmf": true,
+}
+
+func isInterwiki(prefix string) bool {
+	return isLanguageCode(prefix) ||
+		interwikiPrefixes[strings.ToLower(strings.TrimSpace(prefix))]
+}
+
+// Normalize a link target to a main-namespace title, in the format used in
+// <redirect> elements and <title>s.
+//
+// Returns ok=false if target is in another namespace or on another wiki.
+// Section links are stripped of their section. Links to sections of the
+// current page (target starts with '#') produce ok=false.
+func (si *SiteInfo) normalizeTarget(target string) (title string, ok bool) {
+	target = strings.TrimSpace(target)
+	// A leading colon forces a link rather than, e.g., a categorization,
+	// but the target may still be in a non-main namespace.
+	target = strings.TrimPrefix(target, ":")
+
+	if colon := strings.IndexByte(target, ':'); colon != -1 {
+		prefix := target[:colon]
+		if key, ok := si.namespace(prefix); ok && key != 0 {
+			return "", false
+		}
+		if isInterwiki(prefix) {
+			return "", false
+		}
+	}
+
+	// Remove section links.
+	if hash := strings.IndexByte(target, '#'); hash == 0 {
+		return "", false
+	} else if hash != -1 {
+		target = target[:hash]
+	}
+
+	title = si.normalizeTitle(target, 0)
+	return title, title != ""
+}
+
+// Spaces instead of underscores, and uppercase first character for
+// first-letter namespaces.
+func (si *SiteInfo) normalizeTitle(title string, key int) string {
+	title = normSpace(title)
+	if title != "" && si.caseOf(key) != "case-sensitive" {
+		first, size := utf8.DecodeRuneInString(title)
+		// XXX Upper case or title case? Should look up the difference...
+		if unicode.IsLower(first) {
+			title = string(unicode.ToUpper(first)) + title[size:]
+		}
+	}
+	return title
+}
+
+// Normalizes the title of an article as MediaWiki does: spaces instead of
+// underscores, and an uppercase first letter unless si is case-sensitive.
+func (si *SiteInfo) NormalizeTitle(title string) string {
+	return si.normalizeTitle(title, 0)
+}
+
+// Returns the name of a category, given the title of its page, e.g.,
+// "Category:Physicists" gives "Physicists". Returns ok=false if title is not
+// in the category namespace.
+func (si *SiteInfo) CategoryName(title string) (name string, ok bool) {
+	colon := strings.IndexByte(title, ':')
+	if colon == -1 {
+		return "", false
+	}
+	if key, ok := si.namespace(title[:colon]); !ok || key != 14 {
+		return "", false
+	}
+	name = si.normalizeTitle(title[colon+1:], 14)
+	return name, name != ""
+}
@@ -0,0 +1,111 @@
+package wikidump
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestReadSiteInfo(t *testing.T) {
+	f, err := os.Open("nlwiki-20140927-sample.xml")
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+
+	si, err := ReadSiteInfo(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if si.DBName != "nlwiki" {
+		t.Errorf("expected dbname nlwiki, got %q", si.DBName)
+	}
+	if si.Base != "http://nl.wikipedia.org/wiki/Hoofdpagina" {
+		t.Errorf("wrong base URL %q", si.Base)
+	}
+	if si.Case != "first-letter" {
+		t.Errorf("expected case first-letter, got %q", si.Case)
+	}
+	if len(si.Namespaces) != 24 {
+		t.Errorf("expected 24 namespaces, got %d", len(si.Namespaces))
+	}
+
+	for _, c := range []struct {
+		name string
+		key  int
+	}{
+		{"Bestand", 6}, {"categorie", 14}, {"Overleg_gebruiker", 3},
+		{"File", 6}, {"Image", 6}, {"Category", 14},
+		{"WP", 4}, {"G", 2}, {"afbeelding", 6}, {"Overleg_afbeelding", 7},
+	} {
+		if key, ok := si.namespace(c.name); !ok || key != c.key {
+			t.Errorf("expected namespace %d for %q, got %d (%t)",
+				c.key, c.name, key, ok)
+		}
+	}
+	if _, ok := si.namespace("Star Wars"); ok {
+		t.Error(`"Star Wars" recognized as namespace`)
+	}
+
+	// Siteinfo from the API lists namespace aliases.
+	si, err = ReadSiteInfo(strings.NewReader(`<api><query><siteinfo>
+		<dbname>frwiki</dbname>
+		<namespaces><namespace key="6">Fichier</namespace></namespaces>
+		<namespacealiases><ns id="6">Image</ns><ns id="4">WP</ns>
+		</namespacealiases></siteinfo></query></api>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, ok := si.namespace("wp"); !ok || key != 4 {
+		t.Errorf("expected namespace 4 for WP, got %d (%t)", key, ok)
+	}
+}
+
+func TestExtractLinksSiteInfo(t *testing.T) {
+	si := &SiteInfo{
+		Case: "first-letter",
+		Namespaces: []Namespace{
+			{Key: 0, Case: "first-letter"},
+			{Key: 6, Case: "first-letter", Name: "Bestand"},
+			{Key: 14, Case: "first-letter", Name: "Categorie"},
+		},
+		Aliases: map[string]int{"WP": 4, "Afbeelding": 6},
+	}
+
+	cases := []struct {
+		text, target, anchor string
+	}{
+		{"[[Star Wars: Episode IV]]", "Star Wars: Episode IV",
+			"Star Wars: Episode IV"},
+		{"[[Ark: Survival Evolved]]", "Ark: Survival Evolved",
+			"Ark: Survival Evolved"},
+		{"[[ice: the movie]]", "Ice: the movie", "ice: the movie"},
+		{"[[nds-nl:Foo]] [[foo]]", "Foo", "foo"},
+		{"[[Bestand:foo.jpg]] [[foo]]", "Foo", "foo"},
+		{"[[Categorie:Persoon]] [[foo]]", "Foo", "foo"},
+		{"[[File:foo.jpg|thumb]] [[foo]]", "Foo", "foo"},
+		{"[[en:Foo]] [[foo]]", "Foo", "foo"},
+		{"[[de:Foo]] [[foo]]", "Foo", "foo"},
+		{"[[WP:LND|doorverwijspagina]] [[foo]]", "Foo", "foo"},
+		{"[[Afbeelding:x.jpg|thumb|a [[b]]]] [[foo]]", "Foo", "foo"},
+		{"[[wikt:foo]] [[foo]]", "Foo", "foo"},
+		{"[[:Categorie:Persoon]] [[foo]]", "Foo", "foo"},
+		{"[[:foo]]", "Foo", "foo"},
+	}
+	for _, c := range cases {
+		links := si.ExtractLinks(c.text)
+		if len(links) != 1 {
+			t.Errorf("expected one link in %q, got %v", c.text, links)
+			continue
+		}
+		for link := range links {
+			checkLink(t, link, c.target, c.anchor)
+		}
+	}
+
+	si.Case = "case-sensitive"
+	si.Namespaces[0].Case = "case-sensitive"
+	for link := range si.ExtractLinks("[[foo bar]]") {
+		checkLink(t, link, "foo bar", "foo bar")
+	}
+}
@@ -0,0 +1,125 @@
+package wikidump
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Read the rows that a MySQL dump of a Wikipedia table, such as page_props
+// or langlinks, inserts into table, and call f on each of them.
+//
+// Values are returned as strings, with quotes removed and escapes
+// interpreted. NULL becomes the empty string. Stops at the first error
+// returned by f.
+func ReadSQLInserts(r io.Reader, table string, f func(row []string) error) error {
+	prefix := []byte("INSERT INTO `" + table + "` VALUES ")
+	br := bufio.NewReaderSize(r, 1<<16)
+	for {
+		// Lines in Wikipedia's dumps are around 1MB, so ReadSlice won't do.
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 && bytes.HasPrefix(line, prefix) {
+			if perr := parseInsert(line[len(prefix):], f); perr != nil {
+				return perr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+var errSQLSyntax = errors.New("syntax error in SQL dump")
+
+// Parse the tuples in the VALUES part of an INSERT statement.
+func parseInsert(s []byte, f func(row []string) error) error {
+	var value bytes.Buffer
+	for i := 0; i < len(s); {
+		if s[i] != '(' {
+			return errSQLSyntax
+		}
+		i++
+
+		var row []string
+		for {
+			value.Reset()
+			var quoted bool
+			if i < len(s) && s[i] == '\'' {
+				quoted = true
+				for i++; i < len(s) && s[i] != '\''; i++ {
+					c := s[i]
+					if c == '\\' && i+1 < len(s) {
+						i++
+						c = unescapeSQL(s[i])
+					}
+					value.WriteByte(c)
+				}
+				i++ // Closing quote.
+			} else {
+				for ; i < len(s) && s[i] != ',' && s[i] != ')'; i++ {
+					value.WriteByte(s[i])
+				}
+			}
+			if i >= len(s) {
+				return errSQLSyntax
+			}
+
+			v := value.String()
+			if !quoted && v == "NULL" {
+				v = ""
+			}
+			row = append(row, v)
+
+			if s[i] == ')' {
+				i++
+				break
+			} else if s[i] != ',' {
+				return errSQLSyntax
+			}
+			i++
+		}
+
+		if err := f(row); err != nil {
+			return err
+		}
+
+		// Separator between tuples, or end of statement.
+		if i < len(s) && s[i] == ',' {
+			i++
+		} else if i < len(s) && s[i] == ';' {
+			return nil
+		} else {
+			return fmt.Errorf("%v at %q", errSQLSyntax, excerpt(s[i:]))
+		}
+	}
+	return errSQLSyntax
+}
+
+func unescapeSQL(c byte) byte {
+	switch c {
+	case '0':
+		return 0
+	case 'b':
+		return '\b'
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	case 'Z':
+		return 26
+	}
+	return c // \\, \', \" and unknown escapes.
+}
+
+func excerpt(s []byte) []byte {
+	if len(s) > 20 {
+		s = s[:20]
+	}
+	return s
+}
@@ -0,0 +1,43 @@
+package wikidump
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const pagePropsDump = "-- MySQL dump 10.13\n" +
+	"DROP TABLE IF EXISTS `page_props`;\n" +
+	"INSERT INTO `page_props` VALUES (1,'wikibase_item','Q60',NULL)," +
+	"(1,'defaultsort','Speer, Albert',NULL),(2,'displaytitle'," +
+	"'<i>It\\'s</i>\\\\n',1.5);\n" +
+	"INSERT INTO `other` VALUES (3,'wikibase_item','Q1',NULL);\n" +
+	"INSERT INTO `page_props` VALUES (4,'wikibase_item','Q42',NULL);\n"
+
+func TestReadSQLInserts(t *testing.T) {
+	var rows [][]string
+	err := ReadSQLInserts(strings.NewReader(pagePropsDump), "page_props",
+		func(row []string) error {
+			rows = append(rows, row)
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][]string{
+		{"1", "wikibase_item", "Q60", ""},
+		{"1", "defaultsort", "Speer, Albert", ""},
+		{"2", "displaytitle", `<i>It's</i>\n`, "1.5"},
+		{"4", "wikibase_item", "Q42", ""},
+	}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Errorf("expected %q, got %q", expected, rows)
+	}
+
+	err = ReadSQLInserts(strings.NewReader("INSERT INTO `t` VALUES (1,'a'"),
+		"t", func([]string) error { return nil })
+	if err == nil {
+		t.Error("no error for truncated INSERT")
+	}
+}
@@ -20,54 +20,148 @@ var (
 // Assumes tables, templates and tags are properly nested, except for spurious
 // end-of-{table,template,element} tags, which are ignored.
 func Cleanup(s string) string {
-	var depth int
+	text, _ := DefaultSiteInfo.cleanup(s, 0)
+	return text
+}
+
+// Kinds of markup whose content is thrown away by Cleanup.
+type Markup uint
+
+const (
+	TemplateMarkup Markup = 1 << iota // Template calls, including infoboxes.
+	NavboxMarkup                      // Navigation boxes: {{Navbox...}}.
+	TableMarkup                       // Tables: {|...|}.
+	TagMarkup                         // Quasi-XML elements, e.g., <ref>.
+
+	AllMarkup = TemplateMarkup | NavboxMarkup | TableMarkup | TagMarkup
+)
+
+// Elements whose content is never wikitext, or never rendered as links.
+var rawTags = regexp.MustCompile(
+	`^<(math|nowiki|pre|code|source|syntaxhighlight|timeline|score)\b`)
+
+// Like Cleanup, but also returns the text that links should be extracted
+// from: the cleaned-up text plus the content of the markup kinds in keep.
+// Links in templates whose name starts with "Navbox" are only kept if keep
+// includes NavboxMarkup, since these tend to link to loosely related pages.
+//
+// text is the same as Cleanup(s), except that si is used to recognize
+// template names.
+func (si *SiteInfo) CleanupLinks(s string, keep Markup) (text, links string) {
+	return si.cleanup(s, keep)
+}
+
+func (si *SiteInfo) cleanup(s string, keep Markup) (text, links string) {
+	// Stack of enclosing markup. Kinds not in keep are recorded as zero, so
+	// that we only need to count those to know whether we're inside any.
+	var stack []Markup
+	var nskipped int
 	output := bytes.NewBuffer(make([]byte, 0, len(s)))
+	var linkbuf *bytes.Buffer
+	if keep != 0 {
+		linkbuf = bytes.NewBuffer(make([]byte, 0, len(s)))
+	}
+
+	write := func(s string) {
+		if len(stack) == 0 {
+			output.WriteString(s)
+		}
+		if linkbuf != nil && nskipped == 0 {
+			linkbuf.WriteString(s)
+		}
+	}
+	// Kept markup is delimited by newlines in links, so that the text
+	// around it doesn't end up in the anchors of links inside it, or vice
+	// versa.
+	push := func(m Markup) {
+		if m&keep == 0 {
+			m = 0
+			nskipped++
+		} else if nskipped == 0 {
+			linkbuf.WriteByte('\n')
+		}
+		stack = append(stack, m)
+	}
+	pop := func() {
+		if len(stack) == 0 {
+			return
+		}
+		if stack[len(stack)-1] == 0 {
+			nskipped--
+		} else if nskipped == 0 {
+			linkbuf.WriteByte('\n')
+		}
+		stack = stack[:len(stack)-1]
+	}
 
 	for {
 		next := strings.IndexAny(s, "{}|<")
 		if next == -1 {
-			if depth == 0 {
-				output.WriteString(s)
-			}
+			write(s)
 			break
 		}
 
-		if depth == 0 {
-			output.WriteString(s[:next])
-		}
+		write(s[:next])
 		s = s[next:]
 
 		var skip int
-		if strings.HasPrefix(s, "{{") || strings.HasPrefix(s, "{|") {
-			depth++
+		if strings.HasPrefix(s, "{{") {
+			m := TemplateMarkup
+			if keep&(TemplateMarkup|NavboxMarkup) != 0 {
+				m = si.templateKind(s[2:])
+			}
+			push(m)
+			skip = 2
+		} else if strings.HasPrefix(s, "{|") {
+			push(TableMarkup)
 			skip = 2
 		} else if strings.HasPrefix(s, "|}") || strings.HasPrefix(s, "}}") {
-			if depth > 0 {
-				depth--
-			}
+			pop()
 			skip = 2
 		} else if s[0] != '<' {
 			// This case prevents regexp matching for a 20% speedup.
 			skip = 1
 		} else if span := starttag.FindStringIndex(s); span != nil {
-			depth++
+			if keep&TagMarkup != 0 && rawTags.MatchString(s) {
+				push(0)
+			} else {
+				push(TagMarkup)
+			}
 			skip = span[1]
 		} else if span := endtag.FindStringIndex(s); span != nil {
-			if depth > 0 {
-				depth--
-			}
+			pop()
 			skip = span[1]
 		} else {
 			skip = 1
 		}
 
 		// If skip == 1, we didn't find a tag/table marker.
-		if skip == 1 && depth == 0 && len(s) > 0 {
-			output.WriteByte(s[0])
+		if skip == 1 && len(s) > 0 {
+			write(s[:1])
 		}
 		s = s[skip:]
 	}
-	return norm.NFC.String(html.UnescapeString(output.String()))
+
+	text = norm.NFC.String(html.UnescapeString(output.String()))
+	if linkbuf == nil {
+		links = text
+	} else {
+		links = norm.NFC.String(html.UnescapeString(linkbuf.String()))
+	}
+	return
+}
+
+// Kind of template called by the text following "{{".
+func (si *SiteInfo) templateKind(s string) Markup {
+	end := strings.IndexAny(s, "|{}")
+	if end == -1 {
+		return TemplateMarkup
+	}
+	name := si.templateName(s[:end])
+	if len(name) >= 6 && strings.EqualFold(name[:6], "navbox") {
+		return NavboxMarkup
+	}
+	return TemplateMarkup
 }
 
 // A link to the article Target with anchor text Anchor.
@@ -85,7 +179,18 @@ func normSpace(s string) string {
 var linkRE = regexp.MustCompile(`\w*\[\[[^]]+\]\]\w*`)
 
 // Extract all the wikilinks from s. Returns a frequency table.
+//
+// Uses DefaultSiteInfo to recognize namespaces.
 func ExtractLinks(s string) map[Link]int {
+	return DefaultSiteInfo.ExtractLinks(s)
+}
+
+// Extract all the wikilinks to main-namespace pages from s. Returns a
+// frequency table.
+//
+// Links to other namespaces, per si, and interwiki links are skipped. Link
+// targets are normalized according to si's capitalization rule.
+func (si *SiteInfo) ExtractLinks(s string) map[Link]int {
 	freq := make(map[Link]int)
 
 	for _, candidate := range linkRE.FindAllStringSubmatch(s, -1) {
@@ -104,33 +209,131 @@ func ExtractLinks(s string) map[Link]int {
 		} else {
 			target = mid
 			anchor = mid
+			// The leading colon of [[:Foo]] is not displayed.
+			if t := strings.TrimSpace(mid); strings.HasPrefix(t, ":") {
+				anchor = t[1:]
+			}
 		}
 
-		// If the anchor contains a colon, assume it's a file or category link.
-		// XXX Maybe skip matches for `:\s`? Proper solution would parse the
-		// dump to find non-main namespace prefixes.
-		if strings.IndexByte(target, ':') != -1 {
+		target, ok := si.normalizeTarget(target)
+		if !ok {
 			continue
 		}
 
-		// Remove section links.
-		if hash := strings.IndexByte(target, '#'); hash == 0 {
+		anchor = before + anchor + after
+		freq[Link{anchor, target}]++
+	}
+	return freq
+}
+
+// Returns the names of the templates called in s, including nested calls,
+// in order of appearance. Names are normalized like titles, without the
+// template namespace prefix.
+//
+// Parser functions ({{#if:...}}), magic words ({{DEFAULTSORT:...}}) and
+// template parameters ({{{1}}}) are skipped. Uses DefaultSiteInfo.
+func Templates(s string) []string {
+	return DefaultSiteInfo.Templates(s)
+}
+
+// Like Templates, but uses si to recognize the template namespace.
+func (si *SiteInfo) Templates(s string) []string {
+	var names []string
+	for {
+		i := strings.Index(s, "{{")
+		if i == -1 {
+			break
+		}
+		s = s[i+2:]
+		if strings.HasPrefix(s, "{") { // Parameter.
 			continue
-		} else if hash != -1 {
-			target = target[:hash]
 		}
 
-		// Normalize to the format used in <redirect> elements:
-		// uppercase first character, spaces instead of underscores.
-		target = normSpace(target)
-		first, size := utf8.DecodeRuneInString(target)
-		// XXX Upper case or title case? Should look up the difference...
-		if unicode.IsLower(first) {
-			target = string(unicode.ToUpper(first)) + target[size:]
+		end := strings.IndexAny(s, "|{}")
+		if end == -1 {
+			break
+		}
+		if name := si.templateName(s[:end]); name != "" {
+			names = append(names, name)
 		}
+	}
+	return names
+}
 
-		anchor = before + anchor + after
-		freq[Link{anchor, target}]++
+var substPrefixes = []string{"subst:", "safesubst:", "msgnw:"}
+
+func (si *SiteInfo) templateName(name string) string {
+	name = strings.TrimSpace(name)
+	for _, prefix := range substPrefixes {
+		if len(name) >= len(prefix) &&
+			strings.EqualFold(name[:len(prefix)], prefix) {
+			name = strings.TrimSpace(name[len(prefix):])
+		}
 	}
-	return freq
+	if strings.HasPrefix(name, "#") {
+		return ""
+	}
+	if colon := strings.IndexByte(name, ':'); colon != -1 {
+		if key, ok := si.namespace(name[:colon]); !ok || key != 10 {
+			return ""
+		}
+		name = name[colon+1:]
+	}
+
+	name = normSpace(name)
+	if name == "" {
+		return ""
+	}
+	first, size := utf8.DecodeRuneInString(name)
+	return string(unicode.ToUpper(first)) + name[size:]
+}
+
+// Returns the categories that s puts its page in, per its category links,
+// in order of appearance and without duplicates. Categories are named as
+// by SiteInfo.CategoryName. Uses DefaultSiteInfo.
+func Categories(s string) []string {
+	return DefaultSiteInfo.Categories(s)
+}
+
+// Like Categories, but uses si to recognize the category namespace.
+func (si *SiteInfo) Categories(s string) []string {
+	var cats []string
+	seen := make(map[string]bool)
+	for _, m := range linkRE.FindAllString(s, -1) {
+		m = m[strings.Index(m, "[[")+2 : strings.LastIndex(m, "]]")]
+		// Sort key.
+		if pipe := strings.IndexByte(m, '|'); pipe != -1 {
+			m = m[:pipe]
+		}
+		// Links like [[:Category:Foo]] don't categorize.
+		if strings.HasPrefix(strings.TrimSpace(m), ":") {
+			continue
+		}
+		if name, ok := si.CategoryName(strings.TrimSpace(m)); ok && !seen[name] {
+			seen[name] = true
+			cats = append(cats, name)
+		}
+	}
+	return cats
+}
+
+// Names of templates that mark disambiguation pages on various Wikipedias.
+var DefaultDisambigTemplates = []string{
+	"Disambiguation", "Disambig", "Dab", "Disamb", "Geodis", "Hndis",
+	"Numberdis", "Dp", "Dpintro", "Begriffsklärung", "Homonymie",
+	"Disambigua", "Desambiguación", "Desambiguação", "Ujednoznacznienie",
+	"Неоднозначность",
+}
+
+// Reports whether any of the templates is in names. Template names are
+// compared case-insensitively.
+func HasTemplate(templates, names []string) bool {
+	for _, t := range templates {
+		for _, name := range names {
+			if strings.EqualFold(t, name) {
+				return true
+			}
+		}
+	}
+	return false
 }
@@ -2,6 +2,7 @@ package wikidump
 
 import (
 	"os"
+	"reflect"
 	"regexp"
 	"sort"
 	"strings"
@@ -36,6 +37,42 @@ func TestCleanup(t *testing.T) {
 	}
 }
 
+func TestCleanupLinks(t *testing.T) {
+	const page = "{{Infobox person|birth_place=[[Paris]]}}Foo " +
+		"is a {{lang|fr|[[wikt:foo|foo]]}} from [[Lyon]]s.\n" +
+		"{|\n| [[Table cell]]\n|}<ref>[[Reference]]</ref>" +
+		"<nowiki>[[Not a link]]</nowiki>{{Navbox|list=[[Nav link]]}}"
+
+	for _, c := range []struct {
+		keep    Markup
+		targets []string
+	}{
+		{0, []string{"Lyon"}},
+		{TemplateMarkup, []string{"Lyon", "Paris"}},
+		{TableMarkup | TagMarkup, []string{"Lyon", "Reference", "Table cell"}},
+		{AllMarkup, []string{"Lyon", "Nav link", "Paris", "Reference",
+			"Table cell"}},
+	} {
+		text, links := DefaultSiteInfo.CleanupLinks(page, c.keep)
+		if expected := Cleanup(page); text != expected {
+			t.Errorf("expected text %q, got %q", expected, text)
+		}
+
+		var targets []string
+		for link := range ExtractLinks(links) {
+			targets = append(targets, link.Target)
+			if link.Target == "Lyon" && link.Anchor != "Lyons" {
+				t.Errorf("wrong anchor %q for Lyon", link.Anchor)
+			}
+		}
+		sort.Strings(targets)
+		if !reflect.DeepEqual(targets, c.targets) {
+			t.Errorf("expected %q with keep=%d, got %q",
+				c.targets, c.keep, targets)
+		}
+	}
+}
+
 var ws = regexp.MustCompile(`\s+`)
 
 func checkLink(t *testing.T, got Link, target, anchor string) {
@@ -169,6 +206,28 @@ func TestExtractLinks_multiple(t *testing.T) {
 	}
 }
 
+func TestTemplates(t *testing.T) {
+	text := `{{Infobox person
+| name = {{PAGENAME}}
+| birth_date = {{birth date|1905|3|19}}
+}}
+{{subst:dp}} {{Template:Disambig}} {{#if:{{{1|}}}|yes}} {{DEFAULTSORT:Speer}}
+{{Category:Foo}} {{ navbox_bottom }}`
+
+	expected := []string{"Infobox person", "PAGENAME", "Birth date", "Dp",
+		"Disambig", "Navbox bottom"}
+	if got := Templates(text); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	if !HasTemplate(Templates(text), []string{"disambig"}) {
+		t.Error("{{disambig}} not found")
+	}
+	if HasTemplate(Templates(text), []string{"Disambiguation"}) {
+		t.Error("found {{Disambiguation}}, but it's not there")
+	}
+}
+
 func getPages() []string {
 	f, err := os.Open("nlwiki-20140927-sample.xml")
 	if err != nil {
@@ -213,3 +272,20 @@ func BenchmarkExtractLinks(b *testing.B) {
 		b.StopTimer()
 	}
 }
+
+func TestCategories(t *testing.T) {
+	s := "'''Foo''' is a [[bar]].\n[[Category:Physicists|Foo]]\n" +
+		"[[category: fictional_characters ]][[:Category:Not this]]\n" +
+		"[[Category:Physicists]][[Categorie:Not a namespace]]"
+	expected := []string{"Physicists", "Fictional characters"}
+	if cats := Categories(s); !reflect.DeepEqual(cats, expected) {
+		t.Errorf("expected %q, got %q", expected, cats)
+	}
+
+	si := &SiteInfo{Namespaces: []Namespace{{Key: 14, Name: "Categorie"}}}
+	expected = []string{"Physicists", "Fictional characters",
+		"Not a namespace"}
+	if cats := si.Categories(s); !reflect.DeepEqual(cats, expected) {
+		t.Errorf("expected %q, got %q", expected, cats)
+	}
+}